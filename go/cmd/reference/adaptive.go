@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Adaptive concurrency (--workers auto): more concurrent readers help on an SSD, and thrash spinning disks.
+// Each device (see devices.go) gets its own limit on concurrent readers, starting at 1.
+// While the scan runs, the throughput of each device is measured over windows of at least adaptiveWindow,
+// and the limit climbs in one direction while throughput improves, and turns around when it degrades (hill climbing).
+// Throughput is accounted when a file is done, so a window lasts at least until a file completes.
+// Files are started in traversal order: with a limit of 1, a device is read sequentially, as with --workers 1.
+
+// autoWorkers: the value of --workers auto
+const autoWorkers = -1
+
+// adaptiveWindow: minimum duration of a throughput measurement
+var adaptiveWindow = time.Second
+
+// adaptiveTolerance: relative throughput change considered as noise
+const adaptiveTolerance = 0.05
+
+// workersValue: --workers, a positive number or auto
+type workersValue int
+
+func (w *workersValue) String() string {
+	return formatWorkers(int(*w))
+}
+
+func (w *workersValue) Set(value string) error {
+	if value == "auto" {
+		*w = autoWorkers
+		return nil
+	}
+	workers, err := strconv.Atoi(value)
+	if err != nil || workers < 1 {
+		return fmt.Errorf("expected a positive number or auto, got %q", value)
+	}
+	*w = workersValue(workers)
+	return nil
+}
+
+// formatWorkers: a number of workers, or auto
+func formatWorkers(workers int) string {
+	if workers == autoWorkers {
+		return "auto"
+	}
+	return strconv.Itoa(workers)
+}
+
+// adaptiveMaxReaders: the highest limit of concurrent readers per device
+func adaptiveMaxReaders() int {
+	if max := 2 * runtime.NumCPU(); max > 4 {
+		return max
+	}
+	return 4
+}
+
+// readerLimit: the adaptive limit of concurrent readers of a device
+type readerLimit struct {
+	device uint64
+	max    int
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	limit       int
+	active      int
+	direction   int // +1 while climbing, -1 while descending
+	windowStart time.Time
+	windowBytes int64
+	lastRate    float64 // MB/s, of the previous window
+}
+
+func newReaderLimit(device uint64, max int) *readerLimit {
+	l := &readerLimit{device: device, max: max, limit: 1, direction: 1, windowStart: time.Now()}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire: waits until fewer than limit readers are active
+func (l *readerLimit) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+}
+
+// release: a reader is done with size bytes, adjusts the limit at the end of a window
+func (l *readerLimit) release(size int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.windowBytes += size
+	if elapsed := time.Since(l.windowStart); elapsed >= adaptiveWindow {
+		l.adjust(float64(l.windowBytes) / 1024 / 1024 / elapsed.Seconds())
+		l.windowStart, l.windowBytes = time.Now(), 0
+	}
+	l.cond.Broadcast()
+}
+
+// adjust: one hill climbing step, from the throughput of the window which just ended
+func (l *readerLimit) adjust(rate float64) {
+	previous := l.limit
+	var decision string
+	switch {
+	case l.lastRate == 0 || rate > l.lastRate*(1+adaptiveTolerance):
+		decision = "improved, keep going"
+		l.limit += l.direction
+	case rate < l.lastRate*(1-adaptiveTolerance):
+		decision = "degraded, turn around"
+		l.direction = -l.direction
+		l.limit += l.direction
+	case l.direction > 0:
+		// within the noise: more readers may still help
+		decision = "steady, probe up"
+		l.limit++
+	default:
+		// within the noise: fewer readers do as well
+		decision = "steady, hold"
+	}
+	// at a bound, the direction is kept: it only turns around when throughput degrades
+	if l.limit < 1 {
+		l.limit = 1
+	}
+	if l.limit > l.max {
+		l.limit = l.max
+	}
+	if *verboseFlag {
+		log.Printf("workers auto (device %#x): %.2f MB/s with %d readers (previous window %.2f MB/s): %s, %d => %d readers\n",
+			l.device, rate, previous, l.lastRate, decision, previous, l.limit)
+	}
+	l.lastRate = rate
+}
+
+// digestDeviceAdaptive: digests the nodes of a device, with an adaptive number of concurrent readers
+// Returns one error per node, in order
+func digestDeviceAdaptive(device uint64, nodes []*DigestTreeNode) []error {
+	max := adaptiveMaxReaders()
+	limit := newReaderLimit(device, max)
+	errs := make([]error, len(nodes))
+	// up to max workers, each waits for the current limit, then takes the next node:
+	// waiters are not woken in order (sync.Cond), but nodes are still started in traversal order
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < max; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				limit.acquire()
+				i := int(next.Add(1) - 1)
+				if i >= len(nodes) {
+					limit.release(0)
+					return
+				}
+				errs[i] = digestNode(nodes[i])
+				limit.release(nodes[i].Info.Size)
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
+}
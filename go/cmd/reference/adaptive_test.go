@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReaderLimitAdjust(t *testing.T) {
+	limit := newReaderLimit(1, 4)
+	// throughput improves up to 3 readers, then degrades
+	for _, step := range []struct {
+		rate     float64
+		expected int
+	}{
+		{100, 2}, // first window
+		{180, 3}, // improved
+		{240, 4}, // improved
+		{150, 3}, // degraded: turn around
+		{240, 2}, // improved while descending: keep going
+		{180, 3}, // degraded: turn around
+		{182, 4}, // steady while climbing: probe up
+		{120, 3}, // degraded
+		{121, 3}, // steady while descending: hold
+	} {
+		limit.adjust(step.rate)
+		if limit.limit != step.expected {
+			t.Fatalf("after %.0f MB/s: expected %d readers, got %d", step.rate, step.expected, limit.limit)
+		}
+	}
+
+	// throughput keeps improving: the limit stops at the maximum
+	limit = newReaderLimit(1, 4)
+	for i := 0; i < 10; i++ {
+		limit.adjust(100 * float64(i+1))
+	}
+	if limit.limit != 4 {
+		t.Errorf("Expected the limit to stop at 4, got %d", limit.limit)
+	}
+}
+
+func TestDigestTreeAuto(t *testing.T) {
+	defer func() { adaptiveWindow = time.Second }()
+	adaptiveWindow = time.Millisecond
+	rootDirectory := t.TempDir()
+	for i := 0; i < 50; i++ {
+		path := filepath.Join(rootDirectory, fmt.Sprintf("d%d", i%5), fmt.Sprintf("f%d", i))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, 10000*i), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	auto, sequential := digestTestDirectory(t, rootDirectory, autoWorkers), digestTestDirectory(t, rootDirectory, 1)
+	if auto.Info.MetaSha256 != sequential.Info.MetaSha256 {
+		t.Errorf("Expected the same digests with --workers auto")
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BagIt (RFC 8493) packages: https://www.rfc-editor.org/rfc/rfc8493
+// A bag is a directory holding the payload in data/, along with tag files:
+//   bagit.txt               version and encoding declaration
+//   bag-info.txt            metadata, including the Payload-Oxum (octets.streams)
+//   manifest-sha256.txt     digest of every payload file
+//   tagmanifest-sha256.txt  digest of the other tag files
+
+const (
+	bagitVersion        = "1.0"
+	bagitDeclaration    = "bagit.txt"
+	bagInfoFile         = "bag-info.txt"
+	bagManifestFile     = "manifest-sha256.txt"
+	bagTagManifestFile  = "tagmanifest-sha256.txt"
+	bagPayloadDirectory = "data"
+)
+
+var bagManifestLineRegexp = regexp.MustCompile(`^([0-9a-fA-F]{64})[ \t]+(.+)$`)
+
+// writeBagFile: writes a tag file (replaced in tests, to fail)
+var writeBagFile = os.WriteFile
+
+// bagInfoFlags: repeatable --info "Label: value" flag
+type bagInfoFlags []string
+
+func (f *bagInfoFlags) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *bagInfoFlags) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("expected \"Label: value\", got %q", value)
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// bagEncodePath: percent encodes CR, LF and % in a manifest file path (RFC 8493 section 2.1.3)
+func bagEncodePath(path string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(path)
+}
+
+// bagDecodePath: reverses bagEncodePath
+func bagDecodePath(path string) string {
+	return strings.NewReplacer("%25", "%", "%0D", "\r", "%0d", "\r", "%0A", "\n", "%0a", "\n").Replace(path)
+}
+
+// readBagManifest: parses a (tag)manifest file into a map of path to digest
+func readBagManifest(manifestPath string) (map[string]string, error) {
+	manifestFile, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer manifestFile.Close()
+
+	digests := map[string]string{}
+	scanner := bufio.NewScanner(manifestFile)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		matches := bagManifestLineRegexp.FindStringSubmatch(line)
+		if matches == nil {
+			return nil, fmt.Errorf("%s:%d: improperly formatted line %q", manifestPath, lineNumber, line)
+		}
+		path := bagDecodePath(strings.TrimPrefix(matches[2], "./"))
+		digests[path] = strings.ToLower(matches[1])
+	}
+	return digests, scanner.Err()
+}
+
+// readBagInfo: parses a tag file of "Label: value" lines, continuation lines start with white space
+func readBagInfo(infoPath string) ([][2]string, error) {
+	infoFile, err := os.Open(infoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer infoFile.Close()
+
+	var tags [][2]string
+	scanner := bufio.NewScanner(infoFile)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(tags) > 0 {
+			tags[len(tags)-1][1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		label, value, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("%s: improperly formatted line %q", infoPath, line)
+		}
+		tags = append(tags, [2]string{strings.TrimSpace(label), strings.TrimSpace(value)})
+	}
+	return tags, scanner.Err()
+}
+
+// payloadOxum: the Payload-Oxum of a digested tree: total size (from setSizeOfParent) and number of files
+func payloadOxum(node DigestTreeNode) string {
+	var leaves []*DigestTreeNode
+	collectLeaves(&node, &leaves)
+	return fmt.Sprintf("%d.%d", node.Info.Size, len(leaves))
+}
+
+// bagRelPath: the slash separated path of a node relative to the bag directory
+func bagRelPath(bagDirectory string, path string) string {
+	relPath, err := filepath.Rel(bagDirectory, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(relPath)
+}
+
+// isBagLocalPath: whether a slash separated manifest path stays inside the bag directory,
+// and inside subdirectory, unless it is empty
+func isBagLocalPath(relPath string, subdirectory string) bool {
+	localPath := filepath.FromSlash(relPath)
+	if !filepath.IsLocal(localPath) {
+		return false
+	}
+	return subdirectory == "" || strings.HasPrefix(filepath.Clean(localPath), subdirectory+string(filepath.Separator))
+}
+
+// writeBagManifest: writes a manifest of the digested leaves, in traversal order
+func writeBagManifest(bagDirectory string, manifestName string, leaves []*DigestTreeNode) error {
+	var sb strings.Builder
+	for _, leaf := range leaves {
+		fmt.Fprintf(&sb, "%s  %s\n", leaf.Info.Sha256, bagEncodePath(bagRelPath(bagDirectory, leaf.Path)))
+	}
+	return writeBagFile(filepath.Join(bagDirectory, manifestName), []byte(sb.String()), 0644)
+}
+
+// moveEntries: moves the named entries of directory from into directory to
+// On error, the entries already moved are moved back
+func moveEntries(from string, to string, names []string) error {
+	for i, name := range names {
+		if *verboseFlag {
+			log.Printf("bag: moving %s from %s to %s\n", name, from, to)
+		}
+		if err := os.Rename(filepath.Join(from, name), filepath.Join(to, name)); err != nil {
+			for _, movedName := range names[:i] {
+				if undoErr := os.Rename(filepath.Join(to, movedName), filepath.Join(from, movedName)); undoErr != nil {
+					log.Printf("bag: could not move %s back to %s: %v\n", movedName, from, undoErr)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// entryNames: the names of the entries of a directory
+func entryNames(directory string) ([]string, error) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names, nil
+}
+
+// moveIntoPayload: moves the content of bagDirectory into its data/ directory, as bagit-python does
+// A temporary directory is used, so that an existing entry named data can itself be moved.
+// On error, the content is moved back
+func moveIntoPayload(bagDirectory string) error {
+	names, err := entryNames(bagDirectory)
+	if err != nil {
+		return err
+	}
+	tempDirectory, err := os.MkdirTemp(bagDirectory, ".bagit-payload-")
+	if err != nil {
+		return err
+	}
+	if err := moveEntries(bagDirectory, tempDirectory, names); err != nil {
+		os.Remove(tempDirectory)
+		return err
+	}
+	err = os.Chmod(tempDirectory, 0755)
+	if err == nil {
+		err = os.Rename(tempDirectory, filepath.Join(bagDirectory, bagPayloadDirectory))
+	}
+	if err != nil {
+		if undoErr := moveEntries(tempDirectory, bagDirectory, names); undoErr == nil {
+			os.Remove(tempDirectory)
+		}
+		return err
+	}
+	return nil
+}
+
+// restorePayload: undoes moveIntoPayload when a bag could not be completed:
+// removes the tag files, and moves the content of data/ back into bagDirectory
+func restorePayload(bagDirectory string) error {
+	for _, name := range []string{bagitDeclaration, bagInfoFile, bagManifestFile, bagTagManifestFile} {
+		if err := os.Remove(filepath.Join(bagDirectory, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// as in moveIntoPayload, the payload may hold an entry named data
+	tempDirectory, err := os.MkdirTemp(bagDirectory, ".bagit-payload-")
+	if err != nil {
+		return err
+	}
+	payloadPath := filepath.Join(tempDirectory, bagPayloadDirectory)
+	if err := os.Rename(filepath.Join(bagDirectory, bagPayloadDirectory), payloadPath); err != nil {
+		return err
+	}
+	names, err := entryNames(payloadPath)
+	if err != nil {
+		return err
+	}
+	if err := moveEntries(payloadPath, bagDirectory, names); err != nil {
+		return err
+	}
+	if err := os.Remove(payloadPath); err != nil {
+		return err
+	}
+	return os.Remove(tempDirectory)
+}
+
+// createBag: turns bagDirectory into a bag, in place
+// If the bag cannot be completed, the directory is restored as it was
+func createBag(bagDirectory string, info []string, workers int) (err error) {
+	if _, err := os.Stat(filepath.Join(bagDirectory, bagitDeclaration)); err == nil {
+		return fmt.Errorf("%s is already a bag", bagDirectory)
+	}
+	if err := moveIntoPayload(bagDirectory); err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if restoreErr := restorePayload(bagDirectory); restoreErr != nil {
+			log.Printf("bag(%s) could not be restored: %v\n", bagDirectory, restoreErr)
+		} else {
+			log.Printf("bag(%s) restored: %v\n", bagDirectory, err)
+		}
+	}()
+
+	payloadPath := filepath.Join(bagDirectory, bagPayloadDirectory)
+	payloadInfo, err := os.Stat(payloadPath)
+	if err != nil {
+		return err
+	}
+	payloadNode, err := buildTree(payloadPath, payloadInfo)
+	if err != nil {
+		return err
+	}
+	if err := digestTree(&payloadNode, workers); err != nil {
+		return err
+	}
+	var leaves []*DigestTreeNode
+	collectLeaves(&payloadNode, &leaves)
+	if err := writeBagManifest(bagDirectory, bagManifestFile, leaves); err != nil {
+		return err
+	}
+
+	declaration := fmt.Sprintf("BagIt-Version: %s\nTag-File-Character-Encoding: UTF-8\n", bagitVersion)
+	if err := writeBagFile(filepath.Join(bagDirectory, bagitDeclaration), []byte(declaration), 0644); err != nil {
+		return err
+	}
+
+	var bagInfo strings.Builder
+	fmt.Fprintf(&bagInfo, "Bag-Software-Agent: directory-digester %s\n", version)
+	fmt.Fprintf(&bagInfo, "Bagging-Date: %s\n", time.Now().Format("2006-01-02"))
+	fmt.Fprintf(&bagInfo, "Payload-Oxum: %s\n", payloadOxum(payloadNode))
+	for _, tag := range info {
+		label, value, _ := strings.Cut(tag, ":")
+		fmt.Fprintf(&bagInfo, "%s: %s\n", strings.TrimSpace(label), strings.TrimSpace(value))
+	}
+	if err := writeBagFile(filepath.Join(bagDirectory, bagInfoFile), []byte(bagInfo.String()), 0644); err != nil {
+		return err
+	}
+
+	tagLeaves, err := statLeaves(bagDirectory, []string{bagitDeclaration, bagInfoFile, bagManifestFile})
+	if err != nil {
+		return err
+	}
+	for _, err := range digestLeaves(tagLeaves, workers) {
+		if err != nil {
+			return err
+		}
+	}
+	return writeBagManifest(bagDirectory, bagTagManifestFile, tagLeaves)
+}
+
+// statLeaves: leaf nodes for the given slash separated paths, relative to directory
+func statLeaves(directory string, relPaths []string) ([]*DigestTreeNode, error) {
+	var leaves []*DigestTreeNode
+	for _, relPath := range relPaths {
+		path := filepath.Join(directory, filepath.FromSlash(relPath))
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		leaf := newLeaf(path, info)
+		leaves = append(leaves, &leaf)
+	}
+	return leaves, nil
+}
+
+// validateBag: checks that a bag is complete and valid (RFC 8493 section 3)
+// Prints a line per problem found, and returns true if there were none
+func validateBag(bagDirectory string, workers int) (bool, error) {
+	problems := 0
+	report := func(format string, args ...interface{}) {
+		problems++
+		fmt.Printf(format+"\n", args...)
+	}
+
+	tags, err := readBagInfo(filepath.Join(bagDirectory, bagitDeclaration))
+	if err != nil {
+		return false, err
+	}
+	if len(tags) == 0 || tags[0][0] != "BagIt-Version" {
+		report("%s: missing BagIt-Version", bagitDeclaration)
+	}
+
+	payloadPath := filepath.Join(bagDirectory, bagPayloadDirectory)
+	payloadInfo, err := os.Stat(payloadPath)
+	if err != nil {
+		return false, err
+	}
+	payloadNode, err := buildTree(payloadPath, payloadInfo)
+	if err != nil {
+		return false, err
+	}
+
+	// Payload-Oxum is a cheap check, before any hashing
+	if info, err := readBagInfo(filepath.Join(bagDirectory, bagInfoFile)); err == nil {
+		for _, tag := range info {
+			if tag[0] == "Payload-Oxum" && tag[1] != payloadOxum(payloadNode) {
+				report("%s: Payload-Oxum expected %s found %s", bagInfoFile, tag[1], payloadOxum(payloadNode))
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	manifest, err := readBagManifest(filepath.Join(bagDirectory, bagManifestFile))
+	if err != nil {
+		return false, err
+	}
+	if err := digestTree(&payloadNode, workers); err != nil {
+		return false, err
+	}
+	var leaves []*DigestTreeNode
+	collectLeaves(&payloadNode, &leaves)
+	found := map[string]bool{}
+	for _, leaf := range leaves {
+		relPath := bagRelPath(bagDirectory, leaf.Path)
+		found[relPath] = true
+		expected, listed := manifest[relPath]
+		switch {
+		case !listed:
+			report("%s: not listed in %s", relPath, bagManifestFile)
+		case expected != leaf.Info.Sha256:
+			report("%s: sha256 expected %s found %s", relPath, expected, leaf.Info.Sha256)
+		}
+	}
+	for _, relPath := range sortedKeys(manifest) {
+		if !isBagLocalPath(relPath, bagPayloadDirectory) {
+			report("%s: not in the payload (listed in %s)", relPath, bagManifestFile)
+		} else if !found[relPath] {
+			report("%s: missing (listed in %s)", relPath, bagManifestFile)
+		}
+	}
+
+	// the tag manifest is optional
+	tagManifest, err := readBagManifest(filepath.Join(bagDirectory, bagTagManifestFile))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	tagPaths := sortedKeys(tagManifest)
+	var tagLeaves []*DigestTreeNode
+	for _, relPath := range tagPaths {
+		if !isBagLocalPath(relPath, "") {
+			report("%s: not in the bag (listed in %s)", relPath, bagTagManifestFile)
+			continue
+		}
+		statted, err := statLeaves(bagDirectory, []string{relPath})
+		if err != nil {
+			report("%s: missing (listed in %s)", relPath, bagTagManifestFile)
+			continue
+		}
+		tagLeaves = append(tagLeaves, statted...)
+	}
+	for i, err := range digestLeaves(tagLeaves, workers) {
+		relPath := bagRelPath(bagDirectory, tagLeaves[i].Path)
+		if err != nil {
+			report("%s: %v", relPath, err)
+		} else if tagManifest[relPath] != tagLeaves[i].Info.Sha256 {
+			report("%s: sha256 expected %s found %s", relPath, tagManifest[relPath], tagLeaves[i].Info.Sha256)
+		}
+	}
+
+	if *verboseFlag {
+		log.Printf("validateBag(%s) files: %d oxum: %s problems: %d\n", bagDirectory, len(leaves), payloadOxum(payloadNode), problems)
+	}
+	return problems == 0, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// bagCommand: reference bag [--workers n] [--info "Label: value"]... <directory>
+func bagCommand(args []string) error {
+	flags := flag.NewFlagSet("bag", flag.ExitOnError)
+	flags.BoolVar(verboseFlag, "verbose", false, "verbose output")
+	workers := flags.Int("workers", 1, "number of files digested in parallel")
+	var info bagInfoFlags
+	flags.Var(&info, "info", "extra bag-info.txt tag as \"Label: value\" (repeatable)")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: bag [flags] <directory>")
+	}
+	bagDirectory := flags.Arg(0)
+	// the payload of a bag must be complete, nothing is ignored
+	ignorePatterns = nil
+
+	start := time.Now()
+	if err := createBag(bagDirectory, info, *workers); err != nil {
+		return err
+	}
+	log.Printf("bag(%s) created in %.2fs\n", bagDirectory, time.Since(start).Seconds())
+	return nil
+}
+
+// validateBagCommand: reference validate-bag [--workers n] <directory>
+func validateBagCommand(args []string) error {
+	flags := flag.NewFlagSet("validate-bag", flag.ExitOnError)
+	flags.BoolVar(verboseFlag, "verbose", false, "verbose output")
+	workers := flags.Int("workers", 1, "number of files digested in parallel")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: validate-bag [flags] <directory>")
+	}
+	bagDirectory := flags.Arg(0)
+	// the payload of a bag must be complete, nothing is ignored
+	ignorePatterns = nil
+
+	valid, err := validateBag(bagDirectory, *workers)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return errInvalid
+	}
+	fmt.Printf("%s is valid\n", bagDirectory)
+	return nil
+}
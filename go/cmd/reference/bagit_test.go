@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBagRoundTrip(t *testing.T) {
+	bagDirectory := t.TempDir()
+	testFiles := []struct {
+		Path string
+		Data string
+	}{
+		{"test1.txt", "test file 1"},
+		{"data", "a file named like the payload directory"},
+		{"subdir/100%.txt", "test file 3"},
+	}
+	for _, tf := range testFiles {
+		path := filepath.Join(bagDirectory, tf.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(tf.Data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := createBag(bagDirectory, []string{"Source-Organization: test"}, 2); err != nil {
+		t.Fatal(err)
+	}
+	for _, tf := range testFiles {
+		if _, err := os.Stat(filepath.Join(bagDirectory, "data", tf.Path)); err != nil {
+			t.Errorf("Expected %s to be moved into the payload: %v", tf.Path, err)
+		}
+	}
+	manifest, err := readBagManifest(filepath.Join(bagDirectory, bagManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := manifest["data/subdir/100%.txt"]; !ok || len(manifest) != len(testFiles) {
+		t.Errorf("Expected %d manifest entries including data/subdir/100%%.txt, got %v", len(testFiles), manifest)
+	}
+
+	valid, err := validateBag(bagDirectory, 2)
+	if err != nil || !valid {
+		t.Fatalf("Expected a valid bag, got %v %v", valid, err)
+	}
+
+	// a modified payload file invalidates the bag
+	if err := os.WriteFile(filepath.Join(bagDirectory, "data", "test1.txt"), []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	valid, err = validateBag(bagDirectory, 2)
+	if err != nil || valid {
+		t.Fatalf("Expected an invalid bag, got %v %v", valid, err)
+	}
+}
+
+func TestBagPathEncoding(t *testing.T) {
+	path := "data/odd%name\r\nhere"
+	encoded := bagEncodePath(path)
+	if encoded != "data/odd%25name%0D%0Ahere" {
+		t.Errorf("Unexpected encoding %q", encoded)
+	}
+	if decoded := bagDecodePath(encoded); decoded != path {
+		t.Errorf("Expected %q, but got %q", path, decoded)
+	}
+}
+
+func TestBagRestoredOnError(t *testing.T) {
+	bagDirectory := t.TempDir()
+	testFiles := []string{"test1.txt", "data", "subdir/test2.txt"}
+	for _, name := range testFiles {
+		path := filepath.Join(bagDirectory, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the payload manifest is written, and the tag manifest fails
+	defer func() { writeBagFile = os.WriteFile }()
+	writeBagFile = func(name string, data []byte, perm os.FileMode) error {
+		if filepath.Base(name) == bagTagManifestFile {
+			return errors.New("disk full")
+		}
+		return os.WriteFile(name, data, perm)
+	}
+
+	if err := createBag(bagDirectory, nil, 1); err == nil {
+		t.Fatal("Expected the bag to fail")
+	}
+	for _, name := range testFiles {
+		data, err := os.ReadFile(filepath.Join(bagDirectory, name))
+		if err != nil || string(data) != name {
+			t.Errorf("Expected %s to be restored, got %q %v", name, data, err)
+		}
+	}
+	entries, err := os.ReadDir(bagDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("Expected only the original entries, got %v", entries)
+	}
+}
+
+func TestBagManifestPathsConfined(t *testing.T) {
+	rootDirectory := t.TempDir()
+	bagDirectory := filepath.Join(rootDirectory, "bag")
+	if err := os.MkdirAll(bagDirectory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bagDirectory, "test1.txt"), []byte("test file 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// outside the bag, and listed with its correct digest
+	if err := os.WriteFile(filepath.Join(rootDirectory, "outside.txt"), []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := createBag(bagDirectory, nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	outsideSha256 := fmt.Sprintf("%x", sha256.Sum256([]byte("outside")))
+	testCases := []struct {
+		ManifestName string
+		Line         string
+	}{
+		{bagTagManifestFile, outsideSha256 + "  ../outside.txt\n"},
+		{bagManifestFile, outsideSha256 + "  data/../../outside.txt\n"},
+		{bagManifestFile, outsideSha256 + "  bagit.txt\n"},
+	}
+	// the tag manifest is optional, and would otherwise list the modified payload manifest
+	if err := os.Remove(filepath.Join(bagDirectory, bagTagManifestFile)); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range testCases {
+		manifestPath := filepath.Join(bagDirectory, tc.ManifestName)
+		original, err := os.ReadFile(manifestPath)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(manifestPath, append(append([]byte{}, original...), tc.Line...), 0644); err != nil {
+			t.Fatal(err)
+		}
+		valid, err := validateBag(bagDirectory, 1)
+		if err != nil || valid {
+			t.Errorf("Expected %q in %s to invalidate the bag, got %v %v", tc.Line, tc.ManifestName, valid, err)
+		}
+		if err := os.WriteFile(manifestPath, original, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Benchmark results: with --results, a run appends a benchRecord (as a JSON line) to a results file.
+// bench-report aggregates the records into the markdown tables of the README:
+// one table per dataset (--label), one row per machine, runtime, workers, cache state and the options
+// which change performance (--quick, --inventory, --chunk-size, ...), with the minimum and median times across repeated runs.
+
+// benchRecord: one run, as appended to a results file
+type benchRecord struct {
+	Time           time.Time `json:"time"`
+	Host           string    `json:"host"`
+	Runtime        string    `json:"runtime"`
+	Version        string    `json:"version"`
+	Commit         string    `json:"commit"`
+	Label          string    `json:"label"` // the dataset
+	Root           string    `json:"root"`
+	Files          int       `json:"files"`
+	Bytes          int64     `json:"bytes"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	RateMBps       float64   `json:"rate_mb_per_s"`
+	Workers        int       `json:"workers"` // -1 for auto
+	Cache          string    `json:"cache"`   // page cache: cold, warm or unknown
+	XattrCache     bool      `json:"xattr_cache,omitempty"`
+	CachedBytes    int64     `json:"cached_bytes,omitempty"` // with --cache-report
+	Quick          bool      `json:"quick,omitempty"`
+	Inventory      bool      `json:"inventory,omitempty"`
+	ChunkSize      int64     `json:"chunk_size,omitempty"`
+	CdcSize        int64     `json:"cdc_size,omitempty"`
+	BufferSize     int       `json:"buffer_size"` // 0: io.Copy
+	Reader         string    `json:"reader,omitempty"`
+	Fadvise        string    `json:"fadvise,omitempty"`
+}
+
+func newBenchRecord(header manifestHeader, trailer manifestTrailer, label string, workers int, cache string) benchRecord {
+	return benchRecord{
+		Time:           trailer.EndTime,
+		Host:           header.Host,
+		Runtime:        header.Runtime,
+		Version:        header.Version,
+		Commit:         header.Commit,
+		Label:          label,
+		Root:           header.Root,
+		Files:          trailer.Files,
+		Bytes:          trailer.Bytes,
+		ElapsedSeconds: trailer.ElapsedSeconds,
+		RateMBps:       trailer.RateMBps,
+		Workers:        workers,
+		Cache:          cache,
+		XattrCache:     useXattrCache,
+		CachedBytes:    trailer.CachedBytes,
+		Quick:          quickDigest,
+		Inventory:      inventoryMode,
+		ChunkSize:      chunkSize,
+		CdcSize:        cdcSize,
+		BufferSize:     readBufferSize,
+		Reader:         readerBackend,
+		Fadvise:        fadviseMode,
+	}
+}
+
+// options: the options of the run which change performance, as flags; empty for the defaults
+func (record benchRecord) options() string {
+	var options []string
+	if record.Quick {
+		options = append(options, "--quick")
+	}
+	if record.Inventory {
+		options = append(options, "--inventory")
+	}
+	if record.ChunkSize > 0 {
+		options = append(options, "--chunk-size "+formatByteSize(record.ChunkSize))
+	}
+	if record.CdcSize > 0 {
+		options = append(options, "--cdc-size "+formatByteSize(record.CdcSize))
+	}
+	if record.BufferSize > 0 {
+		options = append(options, "--buffer-size "+formatByteSize(int64(record.BufferSize)))
+	}
+	if record.Reader != "" && record.Reader != "std" {
+		options = append(options, "--reader "+record.Reader)
+	}
+	if record.Fadvise != "" {
+		options = append(options, "--fadvise "+record.Fadvise)
+	}
+	if record.XattrCache {
+		options = append(options, "--xattr-cache")
+	}
+	return strings.Join(options, " ")
+}
+
+// appendBenchRecord: appends the record as a JSON line
+func appendBenchRecord(resultsPath string, record benchRecord) error {
+	resultsFile, err := os.OpenFile(resultsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer resultsFile.Close()
+	return json.NewEncoder(resultsFile).Encode(record)
+}
+
+// readBenchRecords: the records of a results file, blank lines are ignored
+func readBenchRecords(r io.Reader) ([]benchRecord, error) {
+	var records []benchRecord
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var record benchRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// median: of a non empty list, which is sorted in place
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	middle := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[middle-1] + values[middle]) / 2
+	}
+	return values[middle]
+}
+
+// benchRow: the repeats of a configuration, on a dataset
+type benchRow struct {
+	Host, Runtime string
+	Workers       int
+	Cache         string
+	Options       string
+	Runs          int
+	MinSeconds    float64
+	MedianSeconds float64
+	DataMB        float64
+	MedianRate    float64 // MB/s
+}
+
+// benchRows: the records grouped by dataset, then by configuration; fastest (median rate) first
+func benchRows(records []benchRecord) map[string][]benchRow {
+	type configuration struct {
+		Label, Host, Runtime string
+		Workers              int
+		Cache, Options       string
+	}
+	groups := map[configuration][]benchRecord{}
+	for _, record := range records {
+		key := configuration{record.Label, record.Host, record.Runtime, record.Workers, record.Cache, record.options()}
+		groups[key] = append(groups[key], record)
+	}
+
+	rows := map[string][]benchRow{}
+	for key, group := range groups {
+		var seconds, rates []float64
+		var dataMB float64
+		for _, record := range group {
+			seconds = append(seconds, record.ElapsedSeconds)
+			rates = append(rates, record.RateMBps)
+			if mb := float64(record.Bytes) / 1024 / 1024; mb > dataMB {
+				dataMB = mb
+			}
+		}
+		medianSeconds := median(seconds) // sorts seconds
+		rows[key.Label] = append(rows[key.Label], benchRow{
+			Host:          key.Host,
+			Runtime:       key.Runtime,
+			Workers:       key.Workers,
+			Cache:         key.Cache,
+			Options:       key.Options,
+			Runs:          len(group),
+			MinSeconds:    seconds[0],
+			MedianSeconds: medianSeconds,
+			DataMB:        dataMB,
+			MedianRate:    median(rates),
+		})
+	}
+	for _, labelRows := range rows {
+		sort.Slice(labelRows, func(i, j int) bool {
+			if labelRows[i].MedianRate != labelRows[j].MedianRate {
+				return labelRows[i].MedianRate > labelRows[j].MedianRate
+			}
+			return labelRows[i].Host < labelRows[j].Host
+		})
+	}
+	return rows
+}
+
+// writeBenchReport: a markdown table per dataset, with the columns of the README's tables (Exec is the runtime,
+// Time and Rate the medians), followed by the configuration and the number of runs
+func writeBenchReport(w io.Writer, records []benchRecord) {
+	rows := benchRows(records)
+	labels := make([]string, 0, len(rows))
+	for label := range rows {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for i, label := range labels {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "### %s\n\n", label)
+		fmt.Fprintf(w, "| Machine | Exec | Time (s) | Data (MB) | Rate (MB/s) | Workers | Cache | Options | Runs | Min (s) |\n")
+		fmt.Fprintf(w, "|:--------|:-----|---------:|----------:|------------:|--------:|:------|:--------|-----:|--------:|\n")
+		for _, row := range rows[label] {
+			fmt.Fprintf(w, "| %s | %s | %.2f | %.2f | %.2f | %s | %s | %s | %d | %.2f |\n",
+				row.Host, row.Runtime, row.MedianSeconds, row.DataMB, row.MedianRate,
+				formatWorkers(row.Workers), row.Cache, row.Options, row.Runs, row.MinSeconds)
+		}
+	}
+}
+
+// benchReportCommand: reference bench-report <results.jsonl>...
+func benchReportCommand(args []string) error {
+	flags := flag.NewFlagSet("bench-report", flag.ExitOnError)
+	label := flags.String("label", "", "only report this dataset")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		return fmt.Errorf("usage: bench-report [--label dataset] <results.jsonl>...")
+	}
+	var records []benchRecord
+	for _, resultsPath := range flags.Args() {
+		resultsFile, err := os.Open(resultsPath)
+		if err != nil {
+			return err
+		}
+		fileRecords, err := readBenchRecords(resultsFile)
+		resultsFile.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", resultsPath, err)
+		}
+		for _, record := range fileRecords {
+			if *label == "" || record.Label == *label {
+				records = append(records, record)
+			}
+		}
+	}
+	writeBenchReport(os.Stdout, records)
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBenchReport(t *testing.T) {
+	results := `{"host":"galois","runtime":"go1.21","label":"Home-Movies","bytes":1048576,"elapsed_seconds":4,"rate_mb_per_s":0.25,"workers":4,"cache":"cold"}
+{"host":"galois","runtime":"go1.21","label":"Home-Movies","bytes":1048576,"elapsed_seconds":1,"rate_mb_per_s":1,"workers":4,"cache":"cold"}
+
+{"host":"galois","runtime":"go1.21","label":"Home-Movies","bytes":1048576,"elapsed_seconds":2,"rate_mb_per_s":0.5,"workers":4,"cache":"cold"}
+{"host":"syno","runtime":"go1.21-docker","label":"Home-Movies","bytes":1048576,"elapsed_seconds":8,"rate_mb_per_s":0.125,"workers":1,"cache":"cold"}
+{"host":"galois","runtime":"go1.21","label":"Home-Movies","bytes":1048576,"elapsed_seconds":0.5,"rate_mb_per_s":2,"workers":4,"cache":"cold","quick":true,"buffer_size":4194304}
+{"host":"syno","runtime":"go1.21-docker","label":"Archive","bytes":2097152,"elapsed_seconds":2,"rate_mb_per_s":1,"workers":1,"cache":"warm"}
+`
+	records, err := readBenchRecords(strings.NewReader(results))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := benchRows(records)
+	movies := rows["Home-Movies"]
+	if len(rows) != 2 || len(movies) != 3 {
+		t.Fatalf("Expected 2 datasets, and 3 rows for Home-Movies, got %v", rows)
+	}
+	// fastest first: the run with other options is not aggregated with the others
+	if movies[0].Options != "--quick --buffer-size 4MiB" || movies[0].Runs != 1 {
+		t.Errorf("Expected a row of its own for --quick --buffer-size 4MiB, got %+v", movies[0])
+	}
+	galois := movies[1]
+	if galois.Host != "galois" || galois.Runs != 3 || galois.MinSeconds != 1 || galois.MedianSeconds != 2 || galois.MedianRate != 0.5 {
+		t.Errorf("Unexpected aggregation of 3 repeats: %+v", galois)
+	}
+	if median([]float64{4, 1, 3, 2}) != 2.5 {
+		t.Errorf("Expected the median of an even count to be the mean of the middle values")
+	}
+
+	var report bytes.Buffer
+	writeBenchReport(&report, records)
+	expected := "| galois | go1.21 | 2.00 | 1.00 | 0.50 | 4 | cold |  | 3 | 1.00 |"
+	if !strings.Contains(report.String(), expected) || strings.Index(report.String(), "### Archive") > strings.Index(report.String(), "### Home-Movies") {
+		t.Errorf("Unexpected report:\n%s", report.String())
+	}
+}
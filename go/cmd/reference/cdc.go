@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash"
+	"log"
+	"time"
+)
+
+// Content-defined chunking (--cdc-size): chunk boundaries are chosen by the content itself (FastCDC),
+// so that an insertion or a deletion only changes the chunks around the edit, not every chunk after it.
+// The chunks of each file (size and sha256) are recorded in the manifest, which shows how much data two versions
+// of a file share (cdc-diff), and how much an archive would take with chunk-level deduplication (dedup-estimate).
+// A file's digest is unchanged: its plain sha256, computed in the same pass.
+//
+// The chunker is FastCDC's (Xia et al., 2016): a gear rolling hash, h = h<<1 + gear[byte], cuts a chunk where
+// the top bits of h are zero. No cut is considered before the minimum size (avg/4), and one is forced at the
+// maximum (avg*8). Normalized chunking: up to the average size, 2 more bits must be zero, and 2 fewer after it,
+// which narrows the distribution of chunk sizes around the average.
+// The gear table is derived from sha256, so that chunk boundaries (and digests) are stable across versions.
+
+// cdcSize: the average chunk size of content-defined chunking (--cdc-size), 0 disables it
+var cdcSize int64
+
+// gear: the random value of each byte, the first 8 bytes of sha256 of the byte
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		digest := sha256.Sum256([]byte{byte(i)})
+		table[i] = binary.BigEndian.Uint64(digest[:8])
+	}
+	return table
+}()
+
+// parseCdcSize: a power of two between 8KiB and 64MiB, or 0
+func parseCdcSize(size string) (int64, error) {
+	bytes, err := parseByteSize(size)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cdc size %q (e.g. 64KiB, 1MiB)", size)
+	}
+	if bytes != 0 && (bytes < 8*1024 || bytes > 64*1024*1024 || bytes&(bytes-1) != 0) {
+		return 0, fmt.Errorf("cdc size %q out of range (a power of two from 8KiB to 64MiB, or 0)", size)
+	}
+	return bytes, nil
+}
+
+// contentChunk: a chunk of a file, in order: its offset is the sum of the sizes of the previous chunks
+type contentChunk struct {
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// contentChunker: an io.Writer which splits what is written to it into content-defined chunks
+// Boundaries do not depend on how writes are split
+type contentChunker struct {
+	minSize, averageSize, maxSize int64
+	maskSmall, maskLarge          uint64
+	file                          hash.Hash // sha256 of all that was written
+	chunk                         hash.Hash // sha256 of the current chunk
+	size                          int64     // of the current chunk
+	rolling                       uint64
+	chunks                        []contentChunk
+}
+
+// newContentChunker: averageSize is a power of two
+func newContentChunker(averageSize int64) *contentChunker {
+	bits := 0
+	for int64(1)<<bits < averageSize {
+		bits++
+	}
+	topBits := func(n int) uint64 { return ^uint64(0) << (64 - n) }
+	return &contentChunker{
+		minSize:     averageSize / 4,
+		averageSize: averageSize,
+		maxSize:     averageSize * 8,
+		maskSmall:   topBits(bits + 2),
+		maskLarge:   topBits(bits - 2),
+		file:        sha256.New(),
+		chunk:       sha256.New(),
+	}
+}
+
+func (c *contentChunker) Write(p []byte) (int, error) {
+	c.file.Write(p)
+	written := len(p)
+	for len(p) > 0 {
+		n, cut := c.boundary(p)
+		c.chunk.Write(p[:n])
+		c.size += int64(n)
+		if cut {
+			c.cut()
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// boundary: how many bytes of p belong to the current chunk, and whether it ends after them
+func (c *contentChunker) boundary(p []byte) (int, bool) {
+	i := 0
+	if c.size < c.minSize {
+		skip := c.minSize - c.size
+		if skip >= int64(len(p)) {
+			return len(p), false
+		}
+		i = int(skip)
+	}
+	rolling := c.rolling
+	// up to the average size, with the small mask
+	end := len(p)
+	if remaining := c.averageSize - 1 - c.size; remaining < int64(end) {
+		end = int(remaining)
+	}
+	for ; i < end; i++ {
+		rolling = rolling<<1 + gear[p[i]]
+		if rolling&c.maskSmall == 0 {
+			return i + 1, true
+		}
+	}
+	// then up to the maximum size, with the large mask
+	end = len(p)
+	remaining := c.maxSize - c.size
+	if remaining <= int64(end) {
+		end = int(remaining)
+	}
+	for ; i < end; i++ {
+		rolling = rolling<<1 + gear[p[i]]
+		if rolling&c.maskLarge == 0 {
+			return i + 1, true
+		}
+	}
+	if int64(i) == remaining {
+		return i, true
+	}
+	c.rolling = rolling
+	return len(p), false
+}
+
+func (c *contentChunker) cut() {
+	c.chunks = append(c.chunks, contentChunk{Size: c.size, Sha256: fmt.Sprintf("%x", c.chunk.Sum(nil))})
+	c.chunk.Reset()
+	c.size = 0
+	c.rolling = 0
+}
+
+// finish: the chunks, including the last one (an empty file has none), and the file's sha256
+func (c *contentChunker) finish() ([]contentChunk, string) {
+	if c.size > 0 {
+		c.cut()
+	}
+	return c.chunks, fmt.Sprintf("%x", c.file.Sum(nil))
+}
+
+// chunkFile: the content-defined chunks of a file, and its sha256
+func chunkFile(path string, averageSize int64) ([]contentChunk, string, error) {
+	chunker := newContentChunker(averageSize)
+	if err := readFile(path, chunker); err != nil {
+		return nil, "", err
+	}
+	chunks, digest := chunker.finish()
+	return chunks, digest, nil
+}
+
+// isContentChunked: whether the chunks of a node are recorded: a regular file which may have more than one
+func isContentChunked(node *DigestTreeNode) bool {
+	return cdcSize > 0 && node.Info.Mode.IsRegular() && node.Info.Size > cdcSize/4
+}
+
+// digestContentChunkedNode: digests a file, and records its chunks if there is more than one
+// (a single chunk is the file itself, with the same sha256). The xattr cache is not used: it does not hold chunks
+func digestContentChunkedNode(node *DigestTreeNode) error {
+	start := time.Now()
+	chunks, digest, err := chunkFile(node.Path, cdcSize)
+	if err != nil {
+		return err
+	}
+	if len(chunks) > 1 {
+		node.Info.ContentChunks = chunks
+	}
+	return setLeafDigest(node, digest, start)
+}
+
+// sharedChunks: the bytes (and number) of chunks which are also in other
+func sharedChunks(chunks []contentChunk, other []contentChunk) (int64, int) {
+	known := map[string]bool{}
+	for _, chunk := range other {
+		known[chunk.Sha256] = true
+	}
+	var bytes int64
+	var count int
+	for _, chunk := range chunks {
+		if known[chunk.Sha256] {
+			bytes += chunk.Size
+			count++
+		}
+	}
+	return bytes, count
+}
+
+// cdcDiffCommand: reference cdc-diff [--cdc-size n] <old file> <new file>
+// Reports how much of the new version of a file is made of chunks of the old one
+func cdcDiffCommand(args []string) error {
+	flags := flag.NewFlagSet("cdc-diff", flag.ExitOnError)
+	flags.BoolVar(verboseFlag, "verbose", false, "verbose output (lists the chunks)")
+	sizeFlag := flags.String("cdc-size", "1MiB", "average chunk size (a power of two, 8KiB to 64MiB)")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: cdc-diff [flags] <old file> <new file>")
+	}
+	averageSize, err := parseCdcSize(*sizeFlag)
+	if err != nil {
+		return err
+	}
+	if averageSize == 0 {
+		return fmt.Errorf("--cdc-size must not be 0")
+	}
+	var versions [2][]contentChunk
+	for i, path := range flags.Args() {
+		chunks, _, err := chunkFile(path, averageSize)
+		if err != nil {
+			return err
+		}
+		versions[i] = chunks
+		var size int64
+		for j, chunk := range chunks {
+			if *verboseFlag {
+				fmt.Printf("  %s chunk %d: offset %d size %d %s\n", path, j, size, chunk.Size, shortDigest(chunk.Sha256, 16))
+			}
+			size += chunk.Size
+		}
+		fmt.Printf("%s: %.2fMB in %d chunks\n", path, float64(size)/1024/1024, len(chunks))
+	}
+	var size int64
+	for _, chunk := range versions[1] {
+		size += chunk.Size
+	}
+	shared, count := sharedChunks(versions[1], versions[0])
+	fmt.Printf("shared: %.2fMB in %d chunks (%.1f%% of the new version) - new data: %.2fMB\n",
+		float64(shared)/1024/1024, count, percent(shared, size), float64(size-shared)/1024/1024)
+	return nil
+}
+
+// percent: part of total, 0 when total is
+func percent(part int64, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(total)
+}
+
+// dedupEstimate: the storage of files, with whole-file and with chunk-level deduplication
+// Files and chunks are all keyed by their sha256: files without recorded chunks (small ones, single chunk ones,
+// or from manifests without --cdc-size) count as a single chunk, the same as a chunk of another file with that content.
+// The digest of a chunked file (--chunk-size) is a Merkle root: its copies are found, but not those digested whole
+type dedupEstimate struct {
+	files                        int
+	bytes, fileBytes, chunkBytes int64
+	uniqueFiles, uniqueChunks    map[string]bool
+}
+
+func newDedupEstimate() *dedupEstimate {
+	return &dedupEstimate{uniqueFiles: map[string]bool{}, uniqueChunks: map[string]bool{}}
+}
+
+// add: accounts for an entry of a manifest, directories, other non regular files and quick digests are ignored
+func (estimate *dedupEstimate) add(entry DigestInfo) {
+	if !entry.Mode.IsRegular() || entry.Sha256 == "" || entry.DigestKind == quickDigestKind {
+		return
+	}
+	estimate.files++
+	estimate.bytes += entry.Size
+	// the chunks of a copy are known, whether they were recorded or not
+	if estimate.uniqueFiles[entry.Sha256] {
+		return
+	}
+	estimate.uniqueFiles[entry.Sha256] = true
+	estimate.fileBytes += entry.Size
+	chunks := entry.ContentChunks
+	if len(chunks) == 0 {
+		chunks = []contentChunk{{Size: entry.Size, Sha256: entry.Sha256}}
+	}
+	for _, chunk := range chunks {
+		if !estimate.uniqueChunks[chunk.Sha256] {
+			estimate.uniqueChunks[chunk.Sha256] = true
+			estimate.chunkBytes += chunk.Size
+		}
+	}
+}
+
+// dedupEstimateCommand: reference dedup-estimate [--map-prefix from=to] <manifest>...
+// Estimates the storage an archive would take with whole-file, and with chunk-level, deduplication
+func dedupEstimateCommand(args []string) error {
+	flags := flag.NewFlagSet("dedup-estimate", flag.ExitOnError)
+	flags.BoolVar(verboseFlag, "verbose", false, "verbose output")
+	var mapPrefixes prefixMaps
+	flags.Var(&mapPrefixes, "map-prefix", "rewrite the manifest's root (or paths) from=to, e.g. /volume1=/Volumes/Space (repeatable)")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		return fmt.Errorf("usage: dedup-estimate [flags] <manifest>...")
+	}
+
+	var averageSize int64
+	estimate := newDedupEstimate()
+	for _, manifestPath := range flags.Args() {
+		loaded, err := loadManifest(manifestPath, mapPrefixes)
+		if err != nil {
+			return err
+		}
+		if size := loaded.Header.CdcSize; size != 0 {
+			if averageSize != 0 && averageSize != size {
+				return fmt.Errorf("%s: chunked with --cdc-size %d, not %d: chunks can not be compared", manifestPath, size, averageSize)
+			}
+			averageSize = size
+		}
+		for _, entry := range loaded.Entries {
+			estimate.add(entry)
+		}
+	}
+	if averageSize == 0 {
+		log.Printf("dedup-estimate: no chunks were recorded (--cdc-size), only whole files are deduplicated\n")
+	}
+	fmt.Printf("files: %d - size: %.2fMB\n", estimate.files, float64(estimate.bytes)/1024/1024)
+	fmt.Printf("whole-file dedup: %.2fMB (%.1f%%) in %d unique files\n",
+		float64(estimate.fileBytes)/1024/1024, percent(estimate.fileBytes, estimate.bytes), len(estimate.uniqueFiles))
+	fmt.Printf("chunk dedup: %.2fMB (%.1f%%) in %d unique chunks (--cdc-size %d)\n",
+		float64(estimate.chunkBytes)/1024/1024, percent(estimate.chunkBytes, estimate.bytes), len(estimate.uniqueChunks), averageSize)
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestContentChunker(t *testing.T) {
+	data := make([]byte, 4*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	averageSize := int64(64 * 1024)
+	chunk := func(data []byte, writeSize int) []contentChunk {
+		chunker := newContentChunker(averageSize)
+		for start := 0; start < len(data); start += writeSize {
+			end := start + writeSize
+			if end > len(data) {
+				end = len(data)
+			}
+			chunker.Write(data[start:end])
+		}
+		chunks, digest := chunker.finish()
+		if digest != fmt.Sprintf("%x", sha256.Sum256(data)) {
+			t.Errorf("Expected the sha256 of the whole content")
+		}
+		return chunks
+	}
+
+	chunks := chunk(data, len(data))
+	var total int64
+	for i, c := range chunks {
+		total += c.Size
+		if c.Size > 8*averageSize || (c.Size < averageSize/4 && i != len(chunks)-1) {
+			t.Errorf("chunk %d: size %d out of bounds", i, c.Size)
+		}
+	}
+	if total != int64(len(data)) || len(chunks) < 16 || len(chunks) > 256 {
+		t.Errorf("Expected about %d chunks covering %d bytes, got %d covering %d", int64(len(data))/averageSize, len(data), len(chunks), total)
+	}
+	// boundaries do not depend on how writes are split
+	if split := chunk(data, 1000); fmt.Sprint(split) != fmt.Sprint(chunks) {
+		t.Errorf("Expected the same chunks with small writes")
+	}
+
+	// an insertion only changes the chunks around it
+	edited := append(append(append([]byte{}, data[:2_000_000]...), bytes.Repeat([]byte("x"), 100)...), data[2_000_000:]...)
+	editedChunks := chunk(edited, 1<<20)
+	shared, _ := sharedChunks(editedChunks, chunks)
+	if shared < int64(len(edited))*9/10 {
+		t.Errorf("Expected most of the edited content to be shared, got %d of %d bytes", shared, len(edited))
+	}
+}
+
+func TestDedupEstimate(t *testing.T) {
+	defer func() { cdcSize = 0 }()
+	cdcSize = 64 * 1024
+	rootDirectory := t.TempDir()
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+	edited := append(append(append([]byte{}, data[:500_000]...), 'x'), data[500_000:]...)
+	for name, content := range map[string][]byte{"a": data, "b": data, "c": edited, "small": []byte("small")} {
+		if err := os.WriteFile(filepath.Join(rootDirectory, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rootNode := digestTestDirectory(t, rootDirectory, 1)
+	if rootNode.Children[0].Info.Sha256 != fmt.Sprintf("%x", sha256.Sum256(data)) || len(rootNode.Children[0].Info.ContentChunks) < 2 {
+		t.Errorf("Expected a plain sha256, and chunks, got %+v", rootNode.Children[0].Info)
+	}
+	if chunks := rootNode.Children[3].Info.ContentChunks; chunks != nil {
+		t.Errorf("Expected no chunks for a small file, got %v", chunks)
+	}
+
+	var entries []DigestInfo
+	convertTreeToListWithPath(rootNode, rootNode.Path, rootNode.Path, &entries)
+	estimate := newDedupEstimate()
+	for _, entry := range entries {
+		estimate.add(entry)
+	}
+	size := int64(len(data))
+	if estimate.files != 4 || estimate.bytes != 3*size+6 || estimate.fileBytes != 2*size+6 {
+		t.Errorf("Expected 2 unique files of 4, got %+v", estimate)
+	}
+	if estimate.chunkBytes <= size || estimate.chunkBytes > size+size/2 {
+		t.Errorf("Expected the edited copy to share most of its chunks, got %d unique bytes", estimate.chunkBytes)
+	}
+
+	// a file of a single chunk, the first chunk of another file: its chunk is not new
+	first := rootNode.Children[0].Info.ContentChunks[0]
+	single := filepath.Join(rootDirectory, "single")
+	if err := os.WriteFile(single, data[:first.Size], 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(single)
+	if err != nil {
+		t.Fatal(err)
+	}
+	singleNode := newLeaf(single, info)
+	if err := digestNode(&singleNode); err != nil {
+		t.Fatal(err)
+	}
+	if singleNode.Info.Sha256 != first.Sha256 || singleNode.Info.ContentChunks != nil {
+		t.Fatalf("Expected a single chunk, with the file's sha256, got %+v", singleNode.Info)
+	}
+	chunkBytes := estimate.chunkBytes
+	estimate.add(singleNode.Info)
+	if estimate.fileBytes != 2*size+6+first.Size || estimate.chunkBytes != chunkBytes {
+		t.Errorf("Expected a new file, made of a known chunk, got %+v", estimate)
+	}
+}
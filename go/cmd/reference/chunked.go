@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"time"
+)
+
+// Chunked digests (--chunk-size): a single large file is otherwise hashed by one goroutine, whatever the number of CPUs.
+// Instead, a file larger than a chunk is split into fixed-size chunks, which are read and hashed in parallel,
+// and its digest is the root of a Merkle tree over the chunks' digests.
+// Each chunk's digest is the plain sha256 of its bytes, and is kept in the manifest:
+// check-chunks uses them to pinpoint which regions of a file changed.
+// As in RFC 6962, the leaves and nodes of the tree are domain separated: a leaf is sha256(0x00 || chunk's digest),
+// and a node with n > 1 leaves is sha256(0x01 || left || right), where left holds the largest power of two smaller than n.
+// Files of a single chunk keep their plain sha256.
+
+// chunkedDigestKind: the digest kind of a file digested in chunks, see DigestInfo.DigestKind
+const chunkedDigestKind = "sha256-merkle"
+
+// chunkSize: size of the chunks of large files (--chunk-size), 0 disables chunked digests
+var chunkSize int64
+
+// chunkWorkers: number of chunks of a file read and hashed in parallel
+var chunkWorkers = runtime.NumCPU()
+
+// minChunkSize: smaller chunks make for a large manifest, and reads too small to be worth parallelizing
+const minChunkSize = 1024 * 1024
+
+// parseChunkSize: a byte size of at least 1MiB, or 0
+func parseChunkSize(size string) (int64, error) {
+	bytes, err := parseByteSize(size)
+	if err != nil {
+		return 0, fmt.Errorf("invalid chunk size %q (e.g. 64MiB, 1GiB)", size)
+	}
+	if bytes != 0 && bytes < minChunkSize {
+		return 0, fmt.Errorf("chunk size %q out of range (at least 1MiB, or 0)", size)
+	}
+	return bytes, nil
+}
+
+// isChunked: whether a node is digested in chunks
+func isChunked(node *DigestTreeNode) bool {
+	return chunkSize > 0 && node.Info.Mode.IsRegular() && node.Info.Size > chunkSize
+}
+
+// digestChunks: the sha256 of each chunk of a file (as hex), read and hashed in parallel
+// The file must still have the expected size, before and after its chunks are read
+func digestChunks(path string, size int64, chunkSize int64) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if err := checkFileSize(file, size); err != nil {
+		return nil, err
+	}
+	if err := beforeRead(file); err != nil {
+		return nil, err
+	}
+
+	count := int((size + chunkSize - 1) / chunkSize)
+	chunks := make([]string, count)
+	errs := runParallel(count, chunkWorkers, func(i int) error {
+		offset := int64(i) * chunkSize
+		length := chunkSize
+		if offset+length > size {
+			length = size - offset
+		}
+		digester := sha256.New()
+		n, err := copyPipelined(digester, io.NewSectionReader(file, offset, length))
+		if err != nil {
+			return err
+		}
+		if n != length {
+			return fmt.Errorf("%s: chunk %d: %w", path, i, io.ErrUnexpectedEOF)
+		}
+		chunks[i] = fmt.Sprintf("%x", digester.Sum(nil))
+		return nil
+	})
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := checkFileSize(file, size); err != nil {
+		return nil, err
+	}
+	if err := afterRead(file); err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+// checkFileSize: the chunks only cover the expected size
+func checkFileSize(file *os.File, size int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != size {
+		return fmt.Errorf("%s: size changed from %d to %d bytes", file.Name(), size, info.Size())
+	}
+	return nil
+}
+
+// merkleRoot: the root of the Merkle tree over the chunks' digests (as hex), each hashed into a leaf with a 0x00 prefix
+func merkleRoot(chunks []string) (string, error) {
+	leaves := make([][]byte, len(chunks))
+	for i, chunk := range chunks {
+		digest, err := hex.DecodeString(chunk)
+		if err != nil || len(digest) != sha256.Size {
+			return "", fmt.Errorf("chunk %d: invalid sha256 %q", i, chunk)
+		}
+		digester := sha256.New()
+		digester.Write([]byte{0x00})
+		digester.Write(digest)
+		leaves[i] = digester.Sum(nil)
+	}
+	var root func(leaves [][]byte) []byte
+	root = func(leaves [][]byte) []byte {
+		if len(leaves) == 1 {
+			return leaves[0]
+		}
+		split := 1
+		for split*2 < len(leaves) {
+			split *= 2
+		}
+		digester := sha256.New()
+		digester.Write([]byte{0x01})
+		digester.Write(root(leaves[:split]))
+		digester.Write(root(leaves[split:]))
+		return digester.Sum(nil)
+	}
+	return fmt.Sprintf("%x", root(leaves)), nil
+}
+
+// digestChunkedNode: digests a large file in chunks, see isChunked
+// The xattr cache is not used: it holds plain sha256 digests
+func digestChunkedNode(node *DigestTreeNode) error {
+	start := time.Now()
+	chunks, err := digestChunks(node.Path, node.Info.Size, chunkSize)
+	if err != nil {
+		return err
+	}
+	digest, err := merkleRoot(chunks)
+	if err != nil {
+		return err
+	}
+	node.Info.DigestKind = chunkedDigestKind
+	node.Info.ChunkSize = chunkSize
+	node.Info.Chunks = chunks
+	return setLeafDigest(node, digest, start)
+}
+
+// checkChunksCommand: reference check-chunks [--workers n] [--map-prefix from=to] <manifest>
+// Rehashes the chunks of every file digested in chunks, and reports the byte ranges which differ
+func checkChunksCommand(args []string) error {
+	flags := flag.NewFlagSet("check-chunks", flag.ExitOnError)
+	flags.BoolVar(verboseFlag, "verbose", false, "verbose output")
+	workers := flags.Int("workers", 1, "number of files checked in parallel")
+	var mapPrefixes prefixMaps
+	flags.Var(&mapPrefixes, "map-prefix", "rewrite the manifest's root (or paths) from=to, e.g. /volume1=/Volumes/Space (repeatable)")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: check-chunks [flags] <manifest>")
+	}
+	loaded, err := loadManifest(flags.Arg(0), mapPrefixes)
+	if err != nil {
+		return err
+	}
+	precision := newManifestIndex(loaded).precision
+	var entries []DigestInfo
+	for _, entry := range loaded.Entries {
+		if entry.DigestKind == chunkedDigestKind {
+			entries = append(entries, entry)
+		}
+	}
+
+	// status of each entry: OK, CORRUPTED (unchanged size and modification time), MODIFIED,
+	// FAILED invalid entry (its chunks do not cover its size, or do not fold back to its sha256), or FAILED open or read
+	statuses := make([]string, len(entries))
+	changes := make([][]string, len(entries))
+	errs := runParallel(len(entries), *workers, func(i int) error {
+		entry := entries[i]
+		if entry.ChunkSize < minChunkSize || int64(len(entry.Chunks)) != (entry.Size+entry.ChunkSize-1)/entry.ChunkSize {
+			log.Printf("%s: %d chunks of %d bytes do not match a size of %d bytes\n", entry.Name, len(entry.Chunks), entry.ChunkSize, entry.Size)
+			statuses[i] = "FAILED invalid entry"
+			return nil
+		}
+		if root, err := merkleRoot(entry.Chunks); err != nil || root != entry.Sha256 {
+			log.Printf("%s: the chunks do not fold back to the sha256 %s (%v)\n", entry.Name, entry.Sha256, err)
+			statuses[i] = "FAILED invalid entry"
+			return nil
+		}
+		info, err := os.Stat(entry.Name)
+		if err != nil {
+			return err
+		}
+		if info.Size() != entry.Size {
+			statuses[i] = fmt.Sprintf("MODIFIED (size %d, was %d)", info.Size(), entry.Size)
+			return nil
+		}
+		chunks, err := digestChunks(entry.Name, entry.Size, entry.ChunkSize)
+		if err != nil {
+			return err
+		}
+		for j, chunk := range chunks {
+			if chunk != entry.Chunks[j] {
+				end := int64(j+1) * entry.ChunkSize
+				if end > entry.Size {
+					end = entry.Size
+				}
+				changes[i] = append(changes[i], fmt.Sprintf("chunk %d: bytes %d-%d", j, int64(j)*entry.ChunkSize, end-1))
+			}
+		}
+		switch {
+		case len(changes[i]) == 0:
+			statuses[i] = "OK"
+		case info.ModTime().UTC().Truncate(precision).Equal(entry.ModTime):
+			statuses[i] = "CORRUPTED"
+		default:
+			statuses[i] = "MODIFIED"
+		}
+		return nil
+	})
+
+	counts := map[string]int{}
+	for i, entry := range entries {
+		if errs[i] != nil {
+			log.Printf("%v\n", errs[i])
+			statuses[i] = "FAILED open or read"
+		}
+		fmt.Printf("%s: %s\n", entry.Name, statuses[i])
+		for _, change := range changes[i] {
+			fmt.Printf("  %s\n", change)
+		}
+		switch statuses[i] {
+		case "OK", "CORRUPTED", "FAILED invalid entry", "FAILED open or read":
+			counts[statuses[i]]++
+		default:
+			counts["MODIFIED"]++
+		}
+	}
+	log.Printf("check-chunks: %d ok - %d corrupted - %d modified - %d invalid - %d unreadable\n",
+		counts["OK"], counts["CORRUPTED"], counts["MODIFIED"], counts["FAILED invalid entry"], counts["FAILED open or read"])
+	if counts["CORRUPTED"] > 0 || counts["FAILED invalid entry"] > 0 || counts["FAILED open or read"] > 0 {
+		return errInvalid
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMerkleRoot(t *testing.T) {
+	hash := func(parts ...[]byte) []byte {
+		digest := sha256.Sum256(bytes.Join(parts, nil))
+		return digest[:]
+	}
+	a, b, c := hash([]byte("a")), hash([]byte("b")), hash([]byte("c"))
+	leafA, leafB, leafC := hash([]byte{0x00}, a), hash([]byte{0x00}, b), hash([]byte{0x00}, c)
+	ab := hash([]byte{0x01}, leafA, leafB)
+	expected := map[int][]byte{
+		1: leafA,
+		2: ab,
+		3: hash([]byte{0x01}, ab, leafC),
+	}
+	leaves := []string{fmt.Sprintf("%x", a), fmt.Sprintf("%x", b), fmt.Sprintf("%x", c)}
+	for count, digest := range expected {
+		root, err := merkleRoot(leaves[:count])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if root != fmt.Sprintf("%x", digest) {
+			t.Errorf("%d leaves: expected %x, got %s", count, digest, root)
+		}
+	}
+}
+
+func TestChunkedDigest(t *testing.T) {
+	defer func() { chunkSize = 0 }()
+	chunkSize = minChunkSize
+	rootDirectory := t.TempDir()
+	large := filepath.Join(rootDirectory, "large")
+	data := bytes.Repeat([]byte("0123456789"), 250_000) // 2.4MiB: 3 chunks
+	if err := os.WriteFile(large, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootDirectory, "small"), []byte("small"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rootNode := digestTestDirectory(t, rootDirectory, 2)
+	largeInfo, smallInfo := rootNode.Children[0].Info, rootNode.Children[1].Info
+	if largeInfo.DigestKind != chunkedDigestKind || largeInfo.ChunkSize != minChunkSize || len(largeInfo.Chunks) != 3 {
+		t.Fatalf("Expected 3 chunks of 1MiB, got %+v", largeInfo)
+	}
+	if last := data[2*minChunkSize:]; largeInfo.Chunks[2] != fmt.Sprintf("%x", sha256.Sum256(last)) {
+		t.Errorf("Expected the last chunk's plain sha256")
+	}
+	if smallInfo.DigestKind != "" || smallInfo.Sha256 != fmt.Sprintf("%x", sha256.Sum256([]byte("small"))) {
+		t.Errorf("Expected a plain sha256 for a file of a single chunk, got %+v", smallInfo)
+	}
+
+	// corrupt the second chunk, without changing the modification time
+	var entries []DigestInfo
+	convertTreeToListWithPath(rootNode, rootNode.Path, rootNode.Path, &entries)
+	manifestJson, err := json.Marshal(manifest{Header: manifestHeader{Root: rootDirectory, Paths: "relative", MtimePrecision: "ns"}, Entries: entries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestPath := filepath.Join(t.TempDir(), "manifest.json")
+	if err := os.WriteFile(manifestPath, manifestJson, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkChunksCommand([]string{manifestPath}); err != nil {
+		t.Errorf("Expected unchanged chunks, got %v", err)
+	}
+	data[minChunkSize+10] = 'x'
+	if err := os.WriteFile(large, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(large, largeInfo.ModTime, largeInfo.ModTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkChunksCommand([]string{manifestPath}); !errors.Is(err, errInvalid) {
+		t.Errorf("Expected a corrupted chunk, got %v", err)
+	}
+}
+
+func TestCheckChunksInvalidEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "large")
+	if err := os.WriteFile(path, make([]byte, 3*minChunkSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+	chunk := fmt.Sprintf("%x", sha256.Sum256(make([]byte, minChunkSize)))
+	root, err := merkleRoot([]string{chunk, chunk, chunk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []DigestInfo{
+		{Name: "large", Size: 3 * minChunkSize, Sha256: root, ChunkSize: 0, Chunks: []string{chunk, chunk, chunk}},
+		{Name: "large", Size: 3 * minChunkSize, Sha256: root, ChunkSize: minChunkSize, Chunks: []string{chunk, chunk}},
+		{Name: "large", Size: 3 * minChunkSize, Sha256: root, ChunkSize: minChunkSize, Chunks: []string{chunk, chunk, chunk, chunk}},
+		// the chunks do not fold back to the sha256, or are not digests
+		{Name: "large", Size: 3 * minChunkSize, Sha256: chunk, ChunkSize: minChunkSize, Chunks: []string{chunk, chunk, chunk}},
+		{Name: "large", Size: 3 * minChunkSize, Sha256: root, ChunkSize: minChunkSize, Chunks: []string{chunk, chunk, "abc"}},
+	} {
+		entry.DigestKind = chunkedDigestKind
+		root := DigestInfo{Name: ".", Mode: os.ModeDir | 0755}
+		manifestJson, err := json.Marshal(manifest{Header: manifestHeader{Root: filepath.Dir(path), Paths: "relative", MtimePrecision: "ns"}, Entries: []DigestInfo{root, entry}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifestPath := filepath.Join(t.TempDir(), "manifest.json")
+		if err := os.WriteFile(manifestPath, manifestJson, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkChunksCommand([]string{manifestPath}); !errors.Is(err, errInvalid) {
+			t.Errorf("chunk_size %d, chunks %v, sha256 %s: expected an invalid entry, got %v", entry.ChunkSize, entry.Chunks, entry.Sha256, err)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dedupe --hardlink: replaces duplicate files with hardlinks to a chosen original.
+// Nothing is changed without --apply. Every file is re-verified byte for byte before it is replaced,
+// and the replacement is atomic: the link is created under a temporary name, then renamed over the duplicate,
+// unless the original or the duplicate changed (size, modification time or inode) since they were compared.
+// With --apply, a --log is required: it is what allows undoing the changes.
+
+// dedupeCandidate: a file of a duplicate group, as found on disk just before deduplication
+type dedupeCandidate struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Mode    os.FileMode
+	Device  uint64
+	Inode   uint64
+	Uid     uint32
+	Gid     uint32
+}
+
+// dedupeLogEntry: one line of the JSON log, with what is needed to undo the change:
+// the duplicate's own mode, modification time and owner are lost when it becomes a link to the original
+type dedupeLogEntry struct {
+	Time            time.Time   `json:"time"`
+	Action          string      `json:"action"` // linked, would-link or skipped
+	Reason          string      `json:"reason,omitempty"`
+	Original        string      `json:"original"`
+	Duplicate       string      `json:"duplicate"`
+	Size            int64       `json:"size"`
+	Sha256          string      `json:"sha256"`
+	DuplicateMode   os.FileMode `json:"duplicate_mode"`
+	DuplicateMtime  time.Time   `json:"duplicate_mtime"`
+	DuplicateUid    uint32      `json:"duplicate_uid"`
+	DuplicateGid    uint32      `json:"duplicate_gid"`
+	DuplicateDevice uint64      `json:"duplicate_device"`
+	DuplicateInode  uint64      `json:"duplicate_inode"`
+}
+
+// chooseOriginal: the index of the file to keep: oldest, shortest path, or first with a preferred prefix
+// Ties are broken by the other criteria, and finally by path
+func chooseOriginal(candidates []dedupeCandidate, keep string, prefer string) int {
+	order := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+	}
+	oldest := func(a, b dedupeCandidate) (bool, bool) {
+		return a.ModTime.Before(b.ModTime), a.ModTime.Equal(b.ModTime)
+	}
+	shortest := func(a, b dedupeCandidate) (bool, bool) {
+		return len(a.Path) < len(b.Path), len(a.Path) == len(b.Path)
+	}
+	preferred := func(a, b dedupeCandidate) (bool, bool) {
+		aPreferred := prefer != "" && strings.HasPrefix(a.Path, prefer)
+		bPreferred := prefer != "" && strings.HasPrefix(b.Path, prefer)
+		return aPreferred && !bPreferred, aPreferred == bPreferred
+	}
+	criteria := []func(a, b dedupeCandidate) (bool, bool){oldest, shortest}
+	switch keep {
+	case "shortest":
+		criteria = []func(a, b dedupeCandidate) (bool, bool){shortest, oldest}
+	case "prefix":
+		criteria = []func(a, b dedupeCandidate) (bool, bool){preferred, oldest, shortest}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := candidates[order[i]], candidates[order[j]]
+		for _, criterion := range criteria {
+			less, equal := criterion(a, b)
+			if !equal {
+				return less
+			}
+		}
+		return a.Path < b.Path
+	})
+	return order[0]
+}
+
+// sameContent: compares two files byte for byte
+func sameContent(pathA, pathB string) (bool, error) {
+	fileA, err := os.Open(pathA)
+	if err != nil {
+		return false, err
+	}
+	defer fileA.Close()
+	fileB, err := os.Open(pathB)
+	if err != nil {
+		return false, err
+	}
+	defer fileB.Close()
+
+	bufA := make([]byte, 1024*1024)
+	bufB := make([]byte, 1024*1024)
+	for {
+		nA, errA := io.ReadFull(fileA, bufA)
+		nB, errB := io.ReadFull(fileB, bufB)
+		if nA != nB || !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return false, nil
+		}
+		endA := errA == io.EOF || errA == io.ErrUnexpectedEOF
+		endB := errB == io.EOF || errB == io.ErrUnexpectedEOF
+		if errA != nil && !endA {
+			return false, errA
+		}
+		if errB != nil && !endB {
+			return false, errB
+		}
+		if endA || endB {
+			return endA && endB, nil
+		}
+	}
+}
+
+// replaceWithHardlink: atomically replaces duplicate with a hardlink to original (same directory rename)
+// The link and the duplicate are stat'ed again just before the rename: the duplicate is left alone
+// if either the original (as linked) or the duplicate changed since they were compared
+func replaceWithHardlink(original dedupeCandidate, duplicate dedupeCandidate) error {
+	tempFile, err := os.CreateTemp(filepath.Dir(duplicate.Path), ".dd-hardlink-")
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	tempFile.Close()
+	// os.Link does not replace an existing file
+	if err := os.Remove(tempPath); err != nil {
+		return err
+	}
+	if err := os.Link(original.Path, tempPath); err != nil {
+		return err
+	}
+	linked := original
+	linked.Path = tempPath
+	if err := checkUnchanged(linked); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("original %v", err)
+	}
+	if err := checkUnchanged(duplicate); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if err := os.Rename(tempPath, duplicate.Path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+// checkUnchanged: whether a file still has the size, modification time and identity it had when stat'ed
+func checkUnchanged(expected dedupeCandidate) error {
+	current, err := statCandidates([]string{expected.Path})
+	if err != nil {
+		return err
+	}
+	found := current[0]
+	if found.Size != expected.Size || !found.ModTime.Equal(expected.ModTime) ||
+		found.Device != expected.Device || found.Inode != expected.Inode {
+		return errors.New("changed since it was compared")
+	}
+	return nil
+}
+
+// statCandidates: the current identity of the files in a group
+func statCandidates(paths []string) ([]dedupeCandidate, error) {
+	var candidates []dedupeCandidate
+	for _, path := range paths {
+		info, err := os.Lstat(path)
+		if err != nil {
+			return nil, err
+		}
+		device, inode, ok := fileIdentity(info)
+		if !ok {
+			return nil, errors.New("hardlinks need device and inode numbers, not available on this platform")
+		}
+		uid, gid, _ := fileOwner(info)
+		candidates = append(candidates, dedupeCandidate{
+			Path:    path,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Mode:    info.Mode(),
+			Device:  device,
+			Inode:   inode,
+			Uid:     uid,
+			Gid:     gid,
+		})
+	}
+	return candidates, nil
+}
+
+// dedupeGroup: hardlinks the duplicates of one group, handling each filesystem (device) separately
+func dedupeGroup(group duplicateGroup, keep string, prefer string, apply bool) ([]dedupeLogEntry, error) {
+	candidates, err := statCandidates(group.Paths)
+	if err != nil {
+		return nil, err
+	}
+	byDevice := map[uint64][]dedupeCandidate{}
+	var devices []uint64
+	for _, candidate := range candidates {
+		if _, ok := byDevice[candidate.Device]; !ok {
+			devices = append(devices, candidate.Device)
+		}
+		byDevice[candidate.Device] = append(byDevice[candidate.Device], candidate)
+	}
+
+	var entries []dedupeLogEntry
+	for _, device := range devices {
+		onDevice := byDevice[device]
+		if len(onDevice) < 2 {
+			continue
+		}
+		original := onDevice[chooseOriginal(onDevice, keep, prefer)]
+		for _, duplicate := range onDevice {
+			if duplicate.Path == original.Path {
+				continue
+			}
+			entry := dedupeLogEntry{
+				Time:            time.Now().UTC(),
+				Original:        original.Path,
+				Duplicate:       duplicate.Path,
+				Size:            group.Size,
+				Sha256:          group.Sha256,
+				DuplicateMode:   duplicate.Mode,
+				DuplicateMtime:  duplicate.ModTime.UTC(),
+				DuplicateUid:    duplicate.Uid,
+				DuplicateGid:    duplicate.Gid,
+				DuplicateDevice: duplicate.Device,
+				DuplicateInode:  duplicate.Inode,
+			}
+			if duplicate.Inode == original.Inode {
+				entry.Action, entry.Reason = "skipped", "already a hardlink"
+				entries = append(entries, entry)
+				continue
+			}
+			same, err := sameContent(original.Path, duplicate.Path)
+			switch {
+			case err != nil:
+				entry.Action, entry.Reason = "skipped", err.Error()
+			case !same:
+				entry.Action, entry.Reason = "skipped", "content differs"
+			case !apply:
+				entry.Action = "would-link"
+			default:
+				if err := replaceWithHardlink(original, duplicate); err != nil {
+					entry.Action, entry.Reason = "skipped", err.Error()
+				} else {
+					entry.Action = "linked"
+				}
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// dedupeCommand: reference dedupe --hardlink [--apply] [--keep oldest|shortest|prefix] [--prefer prefix] [--log file] <directory>
+func dedupeCommand(args []string) error {
+	flags := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	flags.BoolVar(verboseFlag, "verbose", false, "verbose output")
+	workers := flags.Int("workers", 1, "number of files digested in parallel")
+	manifestPath := flags.String("manifest", "", "reuse the digests of unchanged files from a previous --json output")
+	var mapPrefixes prefixMaps
+	flags.Var(&mapPrefixes, "map-prefix", "rewrite the manifest's root (or paths) from=to, e.g. /volume1=/Volumes/Space (repeatable)")
+	minSize := flags.Int64("min-size", 1, "ignore files smaller than this (bytes)")
+	hardlink := flags.Bool("hardlink", false, "replace duplicates with hardlinks to the original (required)")
+	apply := flags.Bool("apply", false, "actually change files, the default is a dry run")
+	keep := flags.String("keep", "oldest", "which copy is the original: oldest, shortest (path) or prefix (see --prefer)")
+	prefer := flags.String("prefer", "", "with --keep prefix: keep the copy whose path starts with this prefix")
+	logPath := flags.String("log", "", "append a JSON line per change to this file (for undo, required with --apply)")
+	flags.Parse(args)
+	if flags.NArg() != 1 || !*hardlink {
+		return fmt.Errorf("usage: dedupe --hardlink [flags] <directory>")
+	}
+	switch *keep {
+	case "oldest", "shortest":
+	case "prefix":
+		if *prefer == "" {
+			return fmt.Errorf("--keep prefix needs --prefer")
+		}
+	default:
+		return fmt.Errorf("unknown --keep %q (oldest, shortest, prefix)", *keep)
+	}
+	if *apply && *logPath == "" {
+		return fmt.Errorf("--apply needs --log, to be able to undo the changes")
+	}
+	rootDirectory := flags.Arg(0)
+
+	index := manifestIndex{}
+	if *manifestPath != "" {
+		loaded, err := loadManifest(*manifestPath, mapPrefixes)
+		if err != nil {
+			return err
+		}
+		index = newManifestIndex(loaded)
+	}
+
+	var logWriter io.Writer = io.Discard
+	if *logPath != "" {
+		logFile, err := os.OpenFile(*logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer logFile.Close()
+		logWriter = logFile
+	}
+
+	rootInfo, err := os.Stat(rootDirectory)
+	if err != nil {
+		return err
+	}
+	rootNode, err := buildTree(rootDirectory, rootInfo)
+	if err != nil {
+		return err
+	}
+	groups, err := findDuplicateFiles(&rootNode, index, *minSize, *workers)
+	if err != nil {
+		return err
+	}
+
+	// existing hardlinks of a duplicate share its storage, it is only reclaimed once
+	var reclaimed int64
+	reclaimedInodes := map[[2]uint64]bool{}
+	linked, skipped := 0, 0
+	encoder := json.NewEncoder(logWriter)
+	for _, group := range groups {
+		entries, err := dedupeGroup(group, *keep, *prefer, *apply)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+			switch entry.Action {
+			case "skipped":
+				skipped++
+				fmt.Printf("skipped: %s (%s)\n", entry.Duplicate, entry.Reason)
+			default:
+				linked++
+				inode := [2]uint64{entry.DuplicateDevice, entry.DuplicateInode}
+				if !reclaimedInodes[inode] {
+					reclaimedInodes[inode] = true
+					reclaimed += entry.Size
+				}
+				fmt.Printf("%s: %s => %s\n", entry.Action, entry.Duplicate, entry.Original)
+			}
+		}
+	}
+
+	verb := "linked"
+	if !*apply {
+		verb = "would link (dry run, use --apply)"
+	}
+	log.Printf("dedupe %s: %d files - reclaimed: %.2fMB - skipped: %d\n", verb, linked, float64(reclaimed)/1024/1024, skipped)
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChooseOriginal(t *testing.T) {
+	now := time.Now()
+	candidates := []dedupeCandidate{
+		{Path: "/archive/backup/Tapes/a.mov", ModTime: now},
+		{Path: "/archive/a.mov", ModTime: now.Add(time.Hour)},
+		{Path: "/archive/old/Tapes/a.mov", ModTime: now.Add(-time.Hour)},
+	}
+	testCases := []struct {
+		Keep     string
+		Prefer   string
+		Expected int
+	}{
+		{"oldest", "", 2},
+		{"shortest", "", 1},
+		{"prefix", "/archive/backup/", 0},
+		{"prefix", "/nowhere/", 2}, // no preferred copy: fall back to oldest
+	}
+	for _, tc := range testCases {
+		if chosen := chooseOriginal(candidates, tc.Keep, tc.Prefer); chosen != tc.Expected {
+			t.Errorf("Expected --keep %s --prefer %q to choose %s, but got %s",
+				tc.Keep, tc.Prefer, candidates[tc.Expected].Path, candidates[chosen].Path)
+		}
+	}
+}
+
+func TestReplaceWithHardlink(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, "original")
+	duplicate := filepath.Join(dir, "duplicate")
+	different := filepath.Join(dir, "different")
+	for path, data := range map[string]string{original: "same content", duplicate: "same content", different: "other content"} {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if same, err := sameContent(original, different); err != nil || same {
+		t.Fatalf("Expected different content, got %v %v", same, err)
+	}
+	if same, err := sameContent(original, duplicate); err != nil || !same {
+		t.Fatalf("Expected same content, got %v %v", same, err)
+	}
+	candidates, err := statCandidates([]string{original, duplicate})
+	if err != nil {
+		t.Skip(err)
+	}
+	if err := replaceWithHardlink(candidates[0], candidates[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	originalInfo, err := os.Stat(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicateInfo, err := os.Stat(duplicate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(originalInfo, duplicateInfo) {
+		t.Errorf("Expected %s to be a hardlink to %s", duplicate, original)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("Expected no temporary file left behind, got %d entries", len(entries))
+	}
+}
+
+func TestReplaceChangedDuplicate(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, "original")
+	duplicate := filepath.Join(dir, "duplicate")
+	for _, path := range []string{original, duplicate} {
+		if err := os.WriteFile(path, []byte("same content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	candidates, err := statCandidates([]string{original, duplicate})
+	if err != nil {
+		t.Skip(err)
+	}
+	// written to after it was compared
+	if err := os.WriteFile(duplicate, []byte("same content, and more"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := replaceWithHardlink(candidates[0], candidates[1]); err == nil {
+		t.Fatal("Expected a changed duplicate not to be replaced")
+	}
+	data, err := os.ReadFile(duplicate)
+	if err != nil || string(data) != "same content, and more" {
+		t.Errorf("Expected the duplicate to be left alone, got %q %v", data, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Expected no temporary file left behind, got %d entries", len(entries))
+	}
+}
+
+func TestReplaceWithChangedOriginal(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, "original")
+	duplicate := filepath.Join(dir, "duplicate")
+	for _, path := range []string{original, duplicate} {
+		if err := os.WriteFile(path, []byte("same content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	candidates, err := statCandidates([]string{original, duplicate})
+	if err != nil {
+		t.Skip(err)
+	}
+	// replaced after it was compared
+	replacement := filepath.Join(dir, "replacement")
+	if err := os.WriteFile(replacement, []byte("other content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(replacement, original); err != nil {
+		t.Fatal(err)
+	}
+	if err := replaceWithHardlink(candidates[0], candidates[1]); err == nil {
+		t.Fatal("Expected a duplicate of a changed original not to be replaced")
+	}
+	data, err := os.ReadFile(duplicate)
+	if err != nil || string(data) != "same content" {
+		t.Errorf("Expected the duplicate to be left alone, got %q %v", data, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Expected no temporary file left behind, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// Per-device scheduling: when a root spans several mounted volumes, reading them one after the other wastes bandwidth.
+// Pending files are grouped by device, and each device gets its own pool of readers: disks are read in parallel,
+// while each disk still sees mostly sequential access (traversal order, with a single worker).
+// Only the scheduling changes: every node is digested the same way, so the output is unchanged.
+
+// groupByDevice: indexes of the nodes, by device, devices in order of first appearance
+func groupByDevice(nodes []*DigestTreeNode) ([]uint64, map[uint64][]int) {
+	var devices []uint64
+	byDevice := map[uint64][]int{}
+	for i, node := range nodes {
+		if _, ok := byDevice[node.Device]; !ok {
+			devices = append(devices, node.Device)
+		}
+		byDevice[node.Device] = append(byDevice[node.Device], i)
+	}
+	return devices, byDevice
+}
+
+// runPerDevice: invokes pool, concurrently, with the nodes of each device (in order)
+// pool returns one error per node it was given; runPerDevice returns one error per node, in the same order as nodes
+func runPerDevice(nodes []*DigestTreeNode, pool func(device uint64, deviceNodes []*DigestTreeNode) []error) []error {
+	devices, byDevice := groupByDevice(nodes)
+	if len(devices) <= 1 {
+		var device uint64
+		if len(devices) == 1 {
+			device = devices[0]
+		}
+		return pool(device, nodes)
+	}
+	if *verboseFlag {
+		log.Printf("runPerDevice: %d files on %d devices\n", len(nodes), len(devices))
+	}
+
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for _, device := range devices {
+		indexes := byDevice[device]
+		deviceNodes := make([]*DigestTreeNode, len(indexes))
+		for i, index := range indexes {
+			deviceNodes[i] = nodes[index]
+		}
+		wg.Add(1)
+		go func(device uint64) {
+			defer wg.Done()
+			for i, err := range pool(device, deviceNodes) {
+				errs[indexes[i]] = err
+			}
+		}(device)
+	}
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunPerDevice(t *testing.T) {
+	var nodes []*DigestTreeNode
+	for i := 0; i < 6; i++ {
+		nodes = append(nodes, &DigestTreeNode{Path: fmt.Sprintf("f%d", i), Device: uint64(i % 2)})
+	}
+	// each device's pool waits for the other one: they must run concurrently
+	started := map[uint64]chan struct{}{0: make(chan struct{}), 1: make(chan struct{})}
+	done := make(chan []error)
+	go func() {
+		done <- runPerDevice(nodes, func(device uint64, deviceNodes []*DigestTreeNode) []error {
+			close(started[device])
+			<-started[1-device]
+			errs := make([]error, len(deviceNodes))
+			for i, node := range deviceNodes {
+				if node.Device != device {
+					errs[i] = errors.New("wrong device")
+				} else if device == 1 {
+					errs[i] = errors.New(node.Path)
+				}
+			}
+			return errs
+		})
+	}()
+	select {
+	case errs := <-done:
+		for i, err := range errs {
+			expected := ""
+			if i%2 == 1 {
+				expected = nodes[i].Path
+			}
+			if (err == nil && expected != "") || (err != nil && err.Error() != expected) {
+				t.Errorf("node %d: expected error %q, got %v", i, expected, err)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the devices to be digested concurrently")
+	}
+}
+
+func TestDigestTreeDevices(t *testing.T) {
+	rootDirectory := t.TempDir()
+	for i := 0; i < 20; i++ {
+		path := filepath.Join(rootDirectory, fmt.Sprintf("d%d", i%3), fmt.Sprintf("f%d", i))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	digest := func(spanDevices bool) DigestTreeNode {
+		rootNode := buildTestTree(t, rootDirectory)
+		if spanDevices { // as if each subdirectory was a mounted volume
+			for i := range rootNode.Children {
+				var leaves []*DigestTreeNode
+				collectLeaves(&rootNode.Children[i], &leaves)
+				for _, leaf := range leaves {
+					leaf.Device = uint64(100 + i)
+				}
+			}
+		}
+		if err := digestTree(&rootNode, 1); err != nil {
+			t.Fatal(err)
+		}
+		return rootNode
+	}
+	if spanning, single := digest(true), digest(false); spanning.Info.MetaSha256 != single.Info.MetaSha256 {
+		t.Errorf("Expected the same digests when the tree spans devices")
+	}
+}
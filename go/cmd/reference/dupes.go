@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+// Duplicate files are found in stages, each stage only reading the candidates left by the previous one:
+//   1- group by size (no reads)
+//   2- group by a partial digest of the first partialDigestSize bytes
+//   3- group by full digest (taken from a manifest when the file is unchanged)
+
+const partialDigestSize = 64 * 1024
+
+// duplicateGroup: files with identical content
+type duplicateGroup struct {
+	Sha256 string   `json:"sha256"`
+	Size   int64    `json:"size"`
+	Count  int      `json:"count"`
+	Wasted int64    `json:"wasted"` // reclaimable bytes: all but one copy
+	Paths  []string `json:"paths"`
+}
+
+// duplicatesReport: the output of the dupes command
+type duplicatesReport struct {
+	Groups    []duplicateGroup `json:"groups"`
+	Redundant int              `json:"redundant"` // copies beyond the first of each group
+	Wasted    int64            `json:"wasted"`
+}
+
+// digestFilePrefix: the sha256 digest (as hex) of the first n bytes of a file
+func digestFilePrefix(path string, n int64) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	digester := sha256.New()
+	if _, err := io.CopyN(digester, file, n); err != nil && err != io.EOF {
+		return "", err
+	}
+	return fmt.Sprintf("%x", digester.Sum(nil)), nil
+}
+
+// groupNodes: groups nodes by key, only keeping groups with at least two members, in first seen order
+func groupNodes(nodes []*DigestTreeNode, key func(node *DigestTreeNode) string) [][]*DigestTreeNode {
+	groups := map[string][]*DigestTreeNode{}
+	var keys []string
+	for _, node := range nodes {
+		k := key(node)
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], node)
+	}
+	var result [][]*DigestTreeNode
+	for _, k := range keys {
+		if len(groups[k]) > 1 {
+			result = append(result, groups[k])
+		}
+	}
+	return result
+}
+
+// findDuplicateFiles: groups the regular files of the (undigested) tree by content
+// Digests found in the index are trusted for unchanged files, the others are computed with the parallel hashing engine
+func findDuplicateFiles(root *DigestTreeNode, index manifestIndex, minSize int64, workers int) ([]duplicateGroup, error) {
+	var leaves, files []*DigestTreeNode
+	collectLeaves(root, &leaves)
+	for _, leaf := range leaves {
+		if leaf.Info.Mode.IsRegular() && leaf.Info.Size >= minSize {
+			if digest, ok := index.lookupDigest(leaf.Path, leaf.Info); ok {
+				leaf.Info.Sha256 = digest
+			}
+			files = append(files, leaf)
+		}
+	}
+
+	// 1- by size
+	sizeGroups := groupNodes(files, func(node *DigestTreeNode) string {
+		return fmt.Sprint(node.Info.Size)
+	})
+
+	// 2- by partial digest, unless every digest in the size group is already known
+	var partialCandidates []*DigestTreeNode
+	var fullCandidates []*DigestTreeNode
+	for _, group := range sizeGroups {
+		allKnown := true
+		for _, node := range group {
+			allKnown = allKnown && node.Info.Sha256 != ""
+		}
+		if allKnown {
+			fullCandidates = append(fullCandidates, group...)
+		} else {
+			partialCandidates = append(partialCandidates, group...)
+		}
+	}
+	partials := make([]string, len(partialCandidates))
+	partialIndex := map[*DigestTreeNode]int{}
+	errs := runParallel(len(partialCandidates), workers, func(i int) error {
+		var err error
+		partials[i], err = digestFilePrefix(partialCandidates[i].Path, partialDigestSize)
+		return err
+	})
+	for i, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+		partialIndex[partialCandidates[i]] = i
+	}
+	partialGroups := groupNodes(partialCandidates, func(node *DigestTreeNode) string {
+		return fmt.Sprintf("%d:%s", node.Info.Size, partials[partialIndex[node]])
+	})
+
+	// 3- by full digest: the partial digest is the full digest for small files
+	var toDigest []*DigestTreeNode
+	for _, group := range partialGroups {
+		for _, node := range group {
+			if node.Info.Sha256 != "" {
+				continue
+			}
+			if node.Info.Size <= partialDigestSize {
+				node.Info.Sha256 = partials[partialIndex[node]]
+			} else {
+				toDigest = append(toDigest, node)
+			}
+		}
+		fullCandidates = append(fullCandidates, group...)
+	}
+	for _, err := range digestLeaves(toDigest, workers) {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if *verboseFlag {
+		log.Printf("findDuplicateFiles files: %d same size: %d same partial digest: %d fully digested: %d\n",
+			len(files), countNodes(sizeGroups), countNodes(partialGroups), len(toDigest))
+	}
+
+	var groups []duplicateGroup
+	for _, group := range groupNodes(fullCandidates, func(node *DigestTreeNode) string {
+		return fmt.Sprintf("%d:%s", node.Info.Size, node.Info.Sha256)
+	}) {
+		duplicates := duplicateGroup{
+			Sha256: group[0].Info.Sha256,
+			Size:   group[0].Info.Size,
+			Count:  len(group),
+			Wasted: group[0].Info.Size * int64(len(group)-1),
+		}
+		for _, node := range group {
+			duplicates.Paths = append(duplicates.Paths, node.Path)
+		}
+		groups = append(groups, duplicates)
+	}
+	sortDuplicateGroups(groups)
+	return groups, nil
+}
+
+// digestTreeWithIndex: digestTree, trusting the index for unchanged files
+func digestTreeWithIndex(root *DigestTreeNode, index manifestIndex, workers int) error {
+	var leaves, toDigest []*DigestTreeNode
+	collectLeaves(root, &leaves)
+	for _, leaf := range leaves {
+		digest, ok := index.lookupDigest(leaf.Path, leaf.Info)
+		if !ok {
+			toDigest = append(toDigest, leaf)
+			continue
+		}
+		leaf.Info.Sha256 = digest
+		metaSha256, err := digestMeta(leaf)
+		if err != nil {
+			return err
+		}
+		leaf.Info.MetaSha256 = metaSha256
+	}
+	for _, err := range digestLeaves(toDigest, workers) {
+		if err != nil {
+			return err
+		}
+	}
+	if err := digestDirectories(root); err != nil {
+		return err
+	}
+	return setRootMeta(root)
+}
+
+// findDuplicateDirectories: groups the directories of the digested tree by digest,
+// only reporting the topmost duplicates: a group is omitted when its members' parents are distinct members
+// of one same duplicate group (it is then already reported through its parents' group)
+func findDuplicateDirectories(root *DigestTreeNode, minSize int64) []duplicateGroup {
+	var directories []*DigestTreeNode
+	parents := map[*DigestTreeNode]*DigestTreeNode{}
+	var collect func(node *DigestTreeNode)
+	collect = func(node *DigestTreeNode) {
+		for i := range node.Children {
+			child := &node.Children[i]
+			if child.Info.Mode.IsDir() {
+				parents[child] = node
+				collect(child)
+			}
+		}
+		// empty directories are all identical
+		if node.Info.Size >= minSize && len(node.Children) > 0 {
+			directories = append(directories, node)
+		}
+	}
+	collect(root)
+
+	byDigest := groupNodes(directories, func(node *DigestTreeNode) string {
+		return node.Info.Sha256
+	})
+	duplicated := map[string]bool{}
+	for _, group := range byDigest {
+		duplicated[group[0].Info.Sha256] = true
+	}
+
+	var groups []duplicateGroup
+	for _, group := range byDigest {
+		if coveredByParents(group, parents, duplicated) {
+			continue
+		}
+		duplicates := duplicateGroup{
+			Sha256: group[0].Info.Sha256,
+			Size:   group[0].Info.Size,
+			Count:  len(group),
+			Wasted: group[0].Info.Size * int64(len(group)-1),
+		}
+		for _, node := range group {
+			duplicates.Paths = append(duplicates.Paths, node.Path)
+		}
+		groups = append(groups, duplicates)
+	}
+	sortDuplicateGroups(groups)
+	return groups
+}
+
+// coveredByParents: whether the members of a group of duplicate directories have distinct parents,
+// all in the same duplicate group
+func coveredByParents(group []*DigestTreeNode, parents map[*DigestTreeNode]*DigestTreeNode, duplicated map[string]bool) bool {
+	seen := map[*DigestTreeNode]bool{}
+	for _, node := range group {
+		parent, ok := parents[node]
+		if !ok || seen[parent] || !duplicated[parent.Info.Sha256] || parent.Info.Sha256 != parents[group[0]].Info.Sha256 {
+			return false
+		}
+		seen[parent] = true
+	}
+	return true
+}
+
+func countNodes(groups [][]*DigestTreeNode) int {
+	count := 0
+	for _, group := range groups {
+		count += len(group)
+	}
+	return count
+}
+
+// sortDuplicateGroups: most reclaimable space first
+func sortDuplicateGroups(groups []duplicateGroup) {
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].Wasted != groups[j].Wasted {
+			return groups[i].Wasted > groups[j].Wasted
+		}
+		return groups[i].Paths[0] < groups[j].Paths[0]
+	})
+}
+
+func newDuplicatesReport(groups []duplicateGroup) duplicatesReport {
+	report := duplicatesReport{Groups: []duplicateGroup{}}
+	report.Groups = append(report.Groups, groups...)
+	for _, group := range groups {
+		report.Redundant += group.Count - 1
+		report.Wasted += group.Wasted
+	}
+	return report
+}
+
+func showDuplicatesAsText(report duplicatesReport) {
+	for _, group := range report.Groups {
+		fmt.Printf("%d copies of %.2fMB - wasted: %.2fMB - digest:%s\n",
+			group.Count, float64(group.Size)/1024/1024, float64(group.Wasted)/1024/1024, shortDigest(group.Sha256, 16))
+		for _, path := range group.Paths {
+			fmt.Printf("  %s\n", path)
+		}
+	}
+	fmt.Printf("duplicates: %d groups - redundant copies: %d - wasted: %.2fMB\n",
+		len(report.Groups), report.Redundant, float64(report.Wasted)/1024/1024)
+}
+
+func showDuplicatesAsJson(report duplicatesReport) error {
+	jsonBytes, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(jsonBytes))
+	return nil
+}
+
+// dupesCommand: reference dupes [--workers n] [--manifest file] [--min-size n] [--dirs] [--json] <directory>
+func dupesCommand(args []string) error {
+	flags := flag.NewFlagSet("dupes", flag.ExitOnError)
+	flags.BoolVar(verboseFlag, "verbose", false, "verbose output")
+	workers := flags.Int("workers", 1, "number of files digested in parallel")
+	manifestPath := flags.String("manifest", "", "reuse the digests of unchanged files from a previous --json output")
+	var mapPrefixes prefixMaps
+	flags.Var(&mapPrefixes, "map-prefix", "rewrite the manifest's root (or paths) from=to, e.g. /volume1=/Volumes/Space (repeatable)")
+	minSize := flags.Int64("min-size", 1, "ignore files smaller than this (bytes)")
+	dirs := flags.Bool("dirs", false, "report identical directories (topmost only) instead of files")
+	jsonOutput := flags.Bool("json", false, "json output")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: dupes [flags] <directory>")
+	}
+	rootDirectory := flags.Arg(0)
+
+	index := manifestIndex{}
+	if *manifestPath != "" {
+		loaded, err := loadManifest(*manifestPath, mapPrefixes)
+		if err != nil {
+			return err
+		}
+		index = newManifestIndex(loaded)
+	}
+
+	rootInfo, err := os.Stat(rootDirectory)
+	if err != nil {
+		return err
+	}
+	rootNode, err := buildTree(rootDirectory, rootInfo)
+	if err != nil {
+		return err
+	}
+	var groups []duplicateGroup
+	if *dirs {
+		if err := digestTreeWithIndex(&rootNode, index, *workers); err != nil {
+			return err
+		}
+		groups = findDuplicateDirectories(&rootNode, *minSize)
+	} else {
+		groups, err = findDuplicateFiles(&rootNode, index, *minSize, *workers)
+		if err != nil {
+			return err
+		}
+	}
+
+	report := newDuplicatesReport(groups)
+	if *jsonOutput {
+		return showDuplicatesAsJson(report)
+	}
+	showDuplicatesAsText(report)
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindDuplicateFiles(t *testing.T) {
+	rootDirectory := t.TempDir()
+	big := bytes.Repeat([]byte("0123456789abcdef"), partialDigestSize/8) // two partial digests long
+	bigVariant := append([]byte{}, big...)
+	bigVariant[len(bigVariant)-1] = 'X' // same size and same prefix, different content
+
+	testFiles := []struct {
+		Path string
+		Data []byte
+	}{
+		{"a/big", big},
+		{"b/big-copy", big},
+		{"c/big-copy", big},
+		{"big-variant", bigVariant},
+		{"a/small", []byte("small")},
+		{"b/small", []byte("small")},
+		{"b/other", []byte("other")},
+		{"empty1", nil},
+		{"empty2", nil},
+	}
+	for _, tf := range testFiles {
+		path := filepath.Join(rootDirectory, tf.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, tf.Data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rootInfo, err := os.Stat(rootDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootNode, err := buildTree(rootDirectory, rootInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := findDuplicateFiles(&rootNode, manifestIndex{}, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 duplicate groups, got %d: %v", len(groups), groups)
+	}
+	// sorted by reclaimable space
+	if groups[0].Count != 3 || groups[0].Wasted != 2*int64(len(big)) {
+		t.Errorf("Expected 3 copies of big first, got %v", groups[0])
+	}
+	if groups[1].Count != 2 || groups[1].Wasted != 5 {
+		t.Errorf("Expected 2 copies of small, got %v", groups[1])
+	}
+}
+
+func TestFindDuplicateDirectories(t *testing.T) {
+	rootDirectory := t.TempDir()
+	testFiles := []string{
+		"Tapes/t1/a.mov",
+		"Tapes/t2/b.mov",
+		"backup1/Tapes/t1/a.mov",
+		"backup1/Tapes/t2/b.mov",
+		"backup1/note.txt",
+		"old/backup/Tapes/t1/a.mov",
+		"old/backup/Tapes/t2/b.mov",
+		"old/backup/note.txt",
+	}
+	for _, relPath := range testFiles {
+		path := filepath.Join(rootDirectory, relPath)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(filepath.Base(relPath)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, relPath := range []string{"emptyA", "emptyB"} {
+		if err := os.Mkdir(filepath.Join(rootDirectory, relPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rootInfo, err := os.Stat(rootDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootNode, err := buildTree(rootDirectory, rootInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := digestTreeWithIndex(&rootNode, manifestIndex{}, 2); err != nil {
+		t.Fatal(err)
+	}
+	groups := findDuplicateDirectories(&rootNode, 1)
+
+	// the t1 and t2 groups are covered by the Tapes group, the empty directories are ignored
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 duplicate directory groups, got %d: %v", len(groups), groups)
+	}
+	expectedCounts := map[string]int{"backup1": 2, "Tapes": 3}
+	for _, group := range groups {
+		name := filepath.Base(group.Paths[0])
+		if expectedCounts[name] != group.Count {
+			t.Errorf("Expected %d copies of %s, got %v", expectedCounts[name], name, group)
+		}
+	}
+}
+
+func TestFindDuplicateDirectoriesAcrossGroups(t *testing.T) {
+	rootDirectory := t.TempDir()
+	// shared is duplicated within the P group and the Q group: it is not covered by either
+	testFiles := []string{
+		"P1/shared/a.mov",
+		"P1/p.txt",
+		"P2/shared/a.mov",
+		"P2/p.txt",
+		"Q1/shared/a.mov",
+		"Q1/q.txt",
+		"Q2/shared/a.mov",
+		"Q2/q.txt",
+	}
+	for _, relPath := range testFiles {
+		path := filepath.Join(rootDirectory, relPath)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(filepath.Base(relPath)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rootNode := digestTestDirectory(t, rootDirectory, 1)
+	groups := findDuplicateDirectories(&rootNode, 1)
+
+	expectedCounts := map[string]int{"P1": 2, "Q1": 2, "shared": 4}
+	if len(groups) != len(expectedCounts) {
+		t.Fatalf("Expected %d duplicate directory groups, got %d: %v", len(expectedCounts), len(groups), groups)
+	}
+	for _, group := range groups {
+		name := filepath.Base(group.Paths[0])
+		if expectedCounts[name] != group.Count {
+			t.Errorf("Expected %d copies of %s, got %v", expectedCounts[name], name, group)
+		}
+	}
+}
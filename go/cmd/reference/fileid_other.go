@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"io/fs"
+)
+
+// fileIdentity: device and inode are not available on this platform
+func fileIdentity(info fs.FileInfo) (device uint64, inode uint64, ok bool) {
+	return 0, 0, false
+}
+
+// fileOwner: numeric owner and group are not available on this platform
+func fileOwner(info fs.FileInfo) (uid uint32, gid uint32, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileIdentity: the device and inode of a file, from the underlying stat(2) structure
+func fileIdentity(info fs.FileInfo) (device uint64, inode uint64, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(stat.Dev), uint64(stat.Ino), true
+}
+
+// fileOwner: the numeric owner and group of a file
+func fileOwner(info fs.FileInfo) (uid uint32, gid uint32, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return stat.Uid, stat.Gid, true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// digestFile: calculates the sha256 digest of a file's content (as hex)
+func digestFile(path string) (string, error) {
+	digester := sha256.New()
+	if err := readFile(path, digester); err != nil {
+		return "", err
+	}
+	// same as hex.EncodeToString(sha[:])
+	return fmt.Sprintf("%x", digester.Sum(nil)), nil
+}
+
+// readFile: writes a file's content to dst (a hash, which does not fail)
+// The file is read through the read/hash pipeline (see pipeline.go)
+// With --fadvise or --cache-report, the page cache is inspected or dropped around the read (see pagecache.go)
+func readFile(path string, dst io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := beforeRead(file); err != nil {
+		return err
+	}
+	if _, err := copyPipelined(dst, file); err != nil {
+		return err
+	}
+	return afterRead(file)
+}
+
+// digestLeaves: the parallel hashing engine.
+// Digests the leaf nodes of each device (see devices.go) using a pool of workers per device;
+// with a single worker, the nodes of a device are digested in order.
+// Each node is only written by the worker that digests it, so no locking is needed.
+// Returns one error per node (nil on success), in the same order as nodes
+// With --workers auto, the number of concurrent readers adapts to each device (see adaptive.go),
+// and with --reader uring, small files are read in batches (see reader.go)
+func digestLeaves(nodes []*DigestTreeNode, workers int) []error {
+	return runPerDevice(nodes, func(device uint64, deviceNodes []*DigestTreeNode) []error {
+		return digestDevice(device, deviceNodes, workers)
+	})
+}
+
+// runParallel: invokes fn(i) for i in [0,count) using a pool of workers
+// Returns one error per invocation, in order
+func runParallel(count int, workers int, fn func(i int) error) []error {
+	errs := make([]error, count)
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				errs[i] = fn(i)
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Inventories (--inventory): the tree's shape, sizes and timestamps, like du, without opening any file:
+// buildTree (and setSizeOfParent) only, in the same output formats, with the digests absent.
+// The header is marked "inventory": true (without an algorithm).
+// upgrade turns an inventory into a full digest manifest: it rebuilds the tree from the inventory's entries,
+// with the inventory's options (mtime precision, mode mask, owner, extended attributes, normalization),
+// and digests its files. Entries which changed since the inventory are reported, and refreshed;
+// entries added since are reported, but not included, and a missing file fails the upgrade.
+// The trailer of the manifest is marked "upgrade": true.
+
+// inventoryMode: --inventory
+var inventoryMode bool
+
+// treeFromManifest: the tree of a manifest loaded by loadManifest (entries in traversal order, by absolute path),
+// without digests. The root is named rootName, which its metadata digest does not account for (see setRootMeta)
+func treeFromManifest(loaded manifest, rootName string) (DigestTreeNode, error) {
+	entries := loaded.Entries
+	if len(entries) == 0 {
+		return DigestTreeNode{}, fmt.Errorf("no entries")
+	}
+	children := map[string][]int{}
+	for i := 1; i < len(entries); i++ {
+		parent := filepath.Dir(entries[i].Name)
+		children[parent] = append(children[parent], i)
+	}
+	count := 0
+	var build func(i int) DigestTreeNode
+	build = func(i int) DigestTreeNode {
+		count++
+		info := entries[i]
+		info.Name = normalizeName(filepath.Base(info.Name))
+		info.RawName, info.Sha256, info.MetaSha256 = "", "", ""
+		info.DigestKind, info.ChunkSize, info.Chunks, info.ContentChunks = "", 0, nil, nil
+		node := DigestTreeNode{Path: entries[i].Name, Info: info}
+		for _, child := range children[entries[i].Name] {
+			node.Children = append(node.Children, build(child))
+		}
+		return node
+	}
+	root := build(0)
+	root.Info.Name = rootName
+	if count != len(entries) {
+		return DigestTreeNode{}, fmt.Errorf("%d entries are not under the root %s", len(entries)-count, entries[0].Name)
+	}
+	return root, nil
+}
+
+// refreshTree: updates the entries which changed since the tree was recorded: files (size, modification time or mode),
+// directories (modification time or mode), and the sizes of directories.
+// Entries added since (not ignored) are reported, but not added to the tree.
+// Returns the number of changed entries, and of added entries
+func refreshTree(node *DigestTreeNode) (changed int, added int, err error) {
+	// as buildTree: the root may be a symlink to a directory, other entries are not followed
+	stat := os.Lstat
+	if node.Info.Mode.IsDir() {
+		stat = os.Stat
+	}
+	info, err := stat(node.Path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w (the inventory is out of date)", err)
+	}
+	node.Device, _, _ = fileIdentity(info)
+	node.ModTime = info.ModTime()
+	fresh := newDigestInfo(info)
+	if !node.Info.Mode.IsDir() {
+		if fresh.Size == node.Info.Size && fresh.ModTime.Equal(node.Info.ModTime) && fresh.Mode == node.Info.Mode {
+			return 0, 0, nil
+		}
+		log.Printf("upgrade: %s changed since the inventory\n", node.Path)
+		node.Info = fresh
+		return 1, 0, setXattrs(node)
+	}
+
+	if !fresh.ModTime.Equal(node.Info.ModTime) || fresh.Mode != node.Info.Mode {
+		log.Printf("upgrade: %s changed since the inventory\n", node.Path)
+		node.Info.ModTime, node.Info.Mode, node.Info.Owner = fresh.ModTime, fresh.Mode, fresh.Owner
+		if err := setXattrs(node); err != nil {
+			return 0, 0, err
+		}
+		changed++
+	}
+	files, err := os.ReadDir(node.Path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w (the inventory is out of date)", err)
+	}
+	recorded := map[string]bool{}
+	for _, child := range node.Children {
+		recorded[filepath.Base(child.Path)] = true
+	}
+	for _, file := range files {
+		if !recorded[file.Name()] && !ignoreName(file.Name()) {
+			log.Printf("upgrade: %s was added since the inventory, and is not included\n", filepath.Join(node.Path, file.Name()))
+			added++
+		}
+	}
+	for i := range node.Children {
+		childChanged, childAdded, err := refreshTree(&node.Children[i])
+		if err != nil {
+			return 0, 0, err
+		}
+		changed += childChanged
+		added += childAdded
+	}
+	setSizeOfParent(node)
+	return changed, added, nil
+}
+
+// restoreOptions: the options of a manifest's header which determine its entries and metadata digests
+func restoreOptions(header manifestHeader) error {
+	if precision, err := parseMtimePrecision(header.MtimePrecision); err == nil {
+		mtimePrecision = precision
+	}
+	if header.ModeMask != "" {
+		mask, err := parseModeMask(header.ModeMask)
+		if err != nil {
+			return err
+		}
+		modeMask = mask
+	}
+	captureOwner, captureXattrs = header.Owner, header.Xattrs
+	xattrInclude, xattrExclude = header.XattrInclude, header.XattrExclude
+	if captureXattrs && !xattrsSupported {
+		return errXattrsUnsupported
+	}
+	if err := checkNameNormalization(header.Options["normalize"]); err != nil {
+		return err
+	}
+	nameNormalization = header.Options["normalize"]
+	absolutePaths = header.Paths == "absolute"
+	return nil
+}
+
+// upgradedHeader: the header of an inventory, once upgraded at start
+// The entries were recorded at the inventory's start time, the digests by this build
+func upgradedHeader(inventory manifestHeader, start time.Time) manifestHeader {
+	header := inventory
+	header.Version, header.Commit, header.BuildDate = version, commit, buildDate
+	header.Inventory = false
+	header.Algorithm = "sha256"
+	header.DigestVersion = digestVersion
+	upgradeTime := start.UTC()
+	header.UpgradeTime = &upgradeTime
+	header.Options = map[string]string{}
+	for name, value := range inventory.Options {
+		if name != "inventory" {
+			header.Options[name] = value
+		}
+	}
+	return header
+}
+
+// upgradeCommand: reference upgrade [--workers n] [--format json|jsonl] <inventory>
+// Digests the files of an inventory (--inventory), and prints the full manifest
+func upgradeCommand(args []string) error {
+	flags := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	flags.BoolVar(verboseFlag, "verbose", false, "verbose output")
+	workers := flags.Int("workers", 1, "number of files digested in parallel")
+	format := flags.String("format", "json", "output format: json, jsonl")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: upgrade [flags] <inventory>")
+	}
+	if *format != "json" && *format != "jsonl" {
+		return fmt.Errorf("unknown --format %q (json, jsonl)", *format)
+	}
+	loaded, err := loadManifest(flags.Arg(0), nil)
+	if err != nil {
+		return err
+	}
+	if !loaded.Header.Inventory {
+		return fmt.Errorf("%s: not an inventory (--inventory)", flags.Arg(0))
+	}
+	if loaded.Trailer == nil {
+		return fmt.Errorf("%s: incomplete inventory (no trailer)", flags.Arg(0))
+	}
+	if err := restoreOptions(loaded.Header); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	rootNode, err := treeFromManifest(loaded, filepath.Base(loaded.Header.Root))
+	if err != nil {
+		return fmt.Errorf("%s: %v", flags.Arg(0), err)
+	}
+	changed, added, err := refreshTree(&rootNode)
+	if err != nil {
+		return err
+	}
+	if err := digestTree(&rootNode, *workers); err != nil {
+		return err
+	}
+
+	header := upgradedHeader(loaded.Header, start)
+	trailer := newManifestTrailer(&rootNode, start)
+	trailer.Upgrade = true
+	log.Printf("upgrade: %d files (%.2fMB) digested in %.2fs - %d entries changed since the inventory - %d added, not included\n",
+		trailer.Files, float64(trailer.Bytes)/1024/1024, trailer.ElapsedSeconds, changed, added)
+	if *format == "jsonl" {
+		return showTreeAsJsonl(rootNode, header, trailer)
+	}
+	return showTreeAsJson(rootNode, header, trailer)
+}
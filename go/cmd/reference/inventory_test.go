@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpgradeInventory(t *testing.T) {
+	rootDirectory := t.TempDir()
+	for _, name := range []string{"a.txt", "sub/b.txt", "sub/deeper/c.txt"} {
+		path := filepath.Join(rootDirectory, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an inventory: no digests
+	defer func() { inventoryMode = false }()
+	inventoryMode = true
+	inventory := buildTestTree(t, rootDirectory)
+	header := newManifestHeader(rootDirectory, time.Now())
+	var entries []DigestInfo
+	convertTreeToListWithPath(inventory, inventory.Path, header.Root, &entries)
+	manifestJson, err := json.Marshal(manifest{Header: header, Entries: entries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestPath := filepath.Join(t.TempDir(), "inventory.json")
+	if err := os.WriteFile(manifestPath, manifestJson, 0644); err != nil {
+		t.Fatal(err)
+	}
+	inventoryMode = false
+	loaded, err := loadManifest(manifestPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Header.Inventory || loaded.Header.Algorithm != "" || loaded.Entries[1].Sha256 != "" {
+		t.Fatalf("Expected an inventory without digests, got %+v", loaded.Header)
+	}
+
+	upgrade := func() (DigestTreeNode, int) {
+		// another spelling of the root than the full digests it is compared with
+		rootNode, err := treeFromManifest(loaded, ".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		changed, added, err := refreshTree(&rootNode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added != 0 {
+			t.Errorf("Expected no added entries, got %d", added)
+		}
+		if err := digestTree(&rootNode, 2); err != nil {
+			t.Fatal(err)
+		}
+		return rootNode, changed
+	}
+	if upgraded, changed := upgrade(); changed != 0 || upgraded.Info.MetaSha256 != digestTestDirectory(t, rootDirectory, 1).Info.MetaSha256 {
+		t.Errorf("Expected the upgraded inventory to match a full digest (%d changed)", changed)
+	}
+
+	// a file changed since the inventory is refreshed
+	if err := os.WriteFile(filepath.Join(rootDirectory, "sub/b.txt"), []byte("longer content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	upgraded, changed := upgrade()
+	if expected := digestTestDirectory(t, rootDirectory, 1); changed != 1 || upgraded.Info.Size != expected.Info.Size || upgraded.Info.MetaSha256 != expected.Info.MetaSha256 {
+		t.Errorf("Expected the changed file to be refreshed (%d changed)", changed)
+	}
+
+	// so is a directory whose mode changed
+	if err := os.Chmod(filepath.Join(rootDirectory, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	upgraded, changed = upgrade()
+	if expected := digestTestDirectory(t, rootDirectory, 1); changed != 2 || upgraded.Children[1].Info.Mode != expected.Children[1].Info.Mode || upgraded.Info.MetaSha256 != expected.Info.MetaSha256 {
+		t.Errorf("Expected the changed directory to be refreshed (%d changed)", changed)
+	}
+
+	// the upgraded header is no longer an inventory's
+	header.Options = map[string]string{"inventory": "true", "mtime-precision": "s"}
+	digestHeader := upgradedHeader(header, time.Now())
+	if digestHeader.Inventory || digestHeader.Options["inventory"] != "" || digestHeader.Options["mtime-precision"] != "s" || header.Options["inventory"] != "true" {
+		t.Errorf("Expected the inventory option to be dropped from a copy of the options, got %v", digestHeader.Options)
+	}
+
+	// entries added since the inventory are reported, and not included
+	if err := os.WriteFile(filepath.Join(rootDirectory, "sub/deeper/new.txt"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rootNode, err := treeFromManifest(loaded, filepath.Base(rootDirectory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, added, err := refreshTree(&rootNode); err != nil || added != 1 {
+		t.Errorf("Expected an added entry, got %d %v", added, err)
+	}
+
+	// the normalization of an inventory is checked, as --normalize is
+	defer func() { nameNormalization = "" }()
+	header.Options = map[string]string{"normalize": "nfkc"}
+	if err := restoreOptions(header); err == nil {
+		t.Errorf("Expected an unknown normalization to be rejected")
+	}
+}
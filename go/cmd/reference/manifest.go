@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A manifest is the --json output of a previous run: a header, a list of DigestInfo, where Name holds the path
+// relative to the root recorded in the header (or the absolute path with --absolute-paths), and a trailer.
+// The header and trailer make a manifest meaningful on its own: how, where and when it was produced, and a summary.
+// With --format jsonl, the header, each entry and the trailer are on their own line: {"header":...}, entries, {"trailer":...}.
+// Nothing is written before the whole tree is digested (a failed run writes no manifest), and the trailer is written last:
+// a manifest without a trailer was cut short while it was written (e.g. a full disk), or is an older manifest.
+// Older manifests were a bare list of DigestInfo, with paths joined onto the root argument;
+// they are still accepted (with a nanosecond precision).
+// When loading, --map-prefix from=to rewrites the root (or the absolute paths) recorded on another host,
+// so that paths line up with this host's (e.g. /volume1=/Volumes/Space).
+
+// digestVersion: identifies how digests are computed: sha256 of file contents (or sha256-merkle, see chunked.go),
+// sha256 of the concatenated hex digests of a directory's children, and metadata digests (see metadata.go)
+const digestVersion = 1
+
+// manifestHeader: how, where and when the entries of a manifest were produced
+type manifestHeader struct {
+	Tool           string            `json:"tool,omitempty"`
+	Version        string            `json:"version,omitempty"`
+	Commit         string            `json:"commit,omitempty"`
+	BuildDate      string            `json:"build_date,omitempty"`
+	Host           string            `json:"host,omitempty"`
+	Runtime        string            `json:"runtime,omitempty"`
+	StartTime      time.Time         `json:"start_time"`
+	Options        map[string]string `json:"options,omitempty"` // the flags given on the command line
+	Algorithm      string            `json:"algorithm,omitempty"`
+	DigestVersion  int               `json:"digest_version,omitempty"`
+	Root           string            `json:"root,omitempty"`  // absolute
+	Paths          string            `json:"paths,omitempty"` // relative or absolute, empty for older manifests
+	MtimePrecision string            `json:"mtime_precision"`
+	Timezone       string            `json:"timezone"`
+	ModeMask       string            `json:"mode_mask,omitempty"`
+	Owner          bool              `json:"owner,omitempty"`
+	Xattrs         bool              `json:"xattrs,omitempty"`
+	XattrInclude   []string          `json:"xattr_include,omitempty"`
+	XattrExclude   []string          `json:"xattr_exclude,omitempty"`
+	ChunkSize      int64             `json:"chunk_size,omitempty"` // files larger than this have sha256-merkle digests
+	CdcSize        int64             `json:"cdc_size,omitempty"`   // average size of the content-defined chunks
+	QuickSize      int64             `json:"quick_size,omitempty"` // with --quick (the algorithm is sha256-quick)
+	QuickSamples   int               `json:"quick_samples,omitempty"`
+	Inventory      bool              `json:"inventory,omitempty"`    // without digests (--inventory)
+	UpgradeTime    *time.Time        `json:"upgrade_time,omitempty"` // when the digests of an inventory were added (upgrade)
+}
+
+// manifestTrailer: a summary of the run, written once all entries are
+type manifestTrailer struct {
+	Files          int       `json:"files"`
+	Directories    int       `json:"directories"`
+	Bytes          int64     `json:"bytes"`
+	EndTime        time.Time `json:"end_time"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	RateMBps       float64   `json:"rate_mb_per_s"`
+	Errors         int64     `json:"errors"`                 // logged without aborting the run
+	CachedBytes    int64     `json:"cached_bytes,omitempty"` // resident in the page cache before they were read (--cache-report)
+	RootSha256     string    `json:"root_sha256,omitempty"`  // absent in inventories
+	RootMetaSha256 string    `json:"root_meta_sha256,omitempty"`
+	Upgrade        bool      `json:"upgrade,omitempty"` // digested by upgrade, from an inventory: entries as of its start_time
+}
+
+type manifest struct {
+	Header  manifestHeader   `json:"header"`
+	Entries []DigestInfo     `json:"entries"`
+	Trailer *manifestTrailer `json:"trailer,omitempty"`
+}
+
+// runErrors: errors which were logged without aborting the run (e.g. a digest that could not be cached)
+var runErrors atomic.Int64
+
+// commandLineOptions: the flags which were set on the command line
+func commandLineOptions() map[string]string {
+	options := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		options[f.Name] = f.Value.String()
+	})
+	return options
+}
+
+func newManifestHeader(root string, start time.Time) manifestHeader {
+	paths := "relative"
+	if absolutePaths {
+		paths = "absolute"
+	}
+	algorithm, algorithmVersion, sampleSize, samples := "sha256", digestVersion, int64(0), 0
+	if quickDigest {
+		algorithm, sampleSize, samples = quickDigestKind, quickSize, quickSamples
+	}
+	if inventoryMode {
+		algorithm, algorithmVersion = "", 0
+	}
+	return manifestHeader{
+		Tool:           "directory-digester",
+		Version:        version,
+		Commit:         commit,
+		BuildDate:      buildDate,
+		Host:           getHostname(),
+		Runtime:        getRuntime(),
+		StartTime:      start.UTC(),
+		Options:        commandLineOptions(),
+		Algorithm:      algorithm,
+		DigestVersion:  algorithmVersion,
+		Root:           root,
+		Paths:          paths,
+		MtimePrecision: formatMtimePrecision(mtimePrecision),
+		Timezone:       "UTC",
+		ModeMask:       formatModeMask(modeMask),
+		Owner:          captureOwner,
+		Xattrs:         captureXattrs,
+		XattrInclude:   xattrInclude,
+		XattrExclude:   xattrExclude,
+		ChunkSize:      chunkSize,
+		CdcSize:        cdcSize,
+		QuickSize:      sampleSize,
+		QuickSamples:   samples,
+		Inventory:      inventoryMode,
+	}
+}
+
+func newManifestTrailer(root *DigestTreeNode, start time.Time) manifestTrailer {
+	end := time.Now()
+	trailer := manifestTrailer{
+		Bytes:          root.Info.Size,
+		EndTime:        end.UTC(),
+		ElapsedSeconds: end.Sub(start).Seconds(),
+		Errors:         runErrors.Load(),
+		CachedBytes:    cachedBytes.Load(),
+		RootSha256:     root.Info.Sha256,
+		RootMetaSha256: root.Info.MetaSha256,
+	}
+	var count func(node *DigestTreeNode)
+	count = func(node *DigestTreeNode) {
+		if !node.Info.Mode.IsDir() {
+			trailer.Files++
+			return
+		}
+		trailer.Directories++
+		for i := range node.Children {
+			count(&node.Children[i])
+		}
+	}
+	count(root)
+	if trailer.ElapsedSeconds > 0 {
+		trailer.RateMBps = float64(trailer.Bytes) / 1024 / 1024 / trailer.ElapsedSeconds
+	}
+	return trailer
+}
+
+// absolutePaths: set by --absolute-paths, manifest entries are relative to the root by default
+var absolutePaths = false
+
+// manifestRoot: the absolute path of the root directory, as recorded in the header
+func manifestRoot(rootDirectory string) string {
+	root, err := filepath.Abs(rootDirectory)
+	if err != nil {
+		return rootDirectory
+	}
+	return root
+}
+
+// manifestEntryPath: the path of a node in a manifest: relative to the root (as given),
+// or joined onto the absolute root with --absolute-paths
+func manifestEntryPath(root string, absoluteRoot string, path string) string {
+	relative, err := filepath.Rel(root, path)
+	if err != nil {
+		return path
+	}
+	if absolutePaths {
+		return filepath.Join(absoluteRoot, relative)
+	}
+	return relative
+}
+
+// prefixMap: a --map-prefix from=to flag value
+type prefixMap struct {
+	From, To string
+}
+
+// prefixMaps: repeatable --map-prefix from=to flag, the first matching prefix applies
+type prefixMaps []prefixMap
+
+func (f *prefixMaps) String() string {
+	var mappings []string
+	for _, mapping := range *f {
+		mappings = append(mappings, mapping.From+"="+mapping.To)
+	}
+	return strings.Join(mappings, ",")
+}
+
+func (f *prefixMaps) Set(value string) error {
+	from, to, ok := strings.Cut(value, "=")
+	if !ok || from == "" {
+		return fmt.Errorf("expected from=to, got %q", value)
+	}
+	*f = append(*f, prefixMap{From: filepath.Clean(from), To: filepath.Clean(to)})
+	return nil
+}
+
+// apply: the path with its prefix replaced; prefixes only match whole path components
+func (f prefixMaps) apply(path string) string {
+	for _, mapping := range f {
+		if path == mapping.From {
+			return mapping.To
+		}
+		if rest, ok := strings.CutPrefix(path, mapping.From); ok && (strings.HasPrefix(rest, string(filepath.Separator)) || mapping.From == string(filepath.Separator)) {
+			return filepath.Join(mapping.To, rest)
+		}
+	}
+	return path
+}
+
+// loadManifest: reads a manifest file, restoring the names which are not valid UTF-8
+// Names are resolved to absolute paths on this host: joined onto the (mapped) root, or mapped
+func loadManifest(manifestPath string, prefixes prefixMaps) (manifest, error) {
+	jsonBytes, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return manifest{}, err
+	}
+	loaded, err := decodeManifest(jsonBytes)
+	if err != nil {
+		return manifest{}, fmt.Errorf("%s: %v", manifestPath, err)
+	}
+	for i := range loaded.Entries {
+		if loaded.Entries[i], err = restoreRawName(loaded.Entries[i]); err != nil {
+			return manifest{}, fmt.Errorf("%s: raw_name of %q: %v", manifestPath, loaded.Entries[i].Name, err)
+		}
+	}
+	if loaded.Header.Root != "" {
+		loaded.Header.Root = prefixes.apply(loaded.Header.Root)
+	}
+	for i := range loaded.Entries {
+		name := loaded.Entries[i].Name
+		if loaded.Header.Paths == "relative" {
+			name = filepath.Join(loaded.Header.Root, name)
+		} else {
+			name = manifestRoot(prefixes.apply(name))
+		}
+		loaded.Entries[i].Name = name
+	}
+	return loaded, nil
+}
+
+// decodeManifest: a json manifest, a jsonl manifest, or an older bare list of entries
+func decodeManifest(jsonBytes []byte) (manifest, error) {
+	var loaded manifest
+	if bytes.HasPrefix(bytes.TrimSpace(jsonBytes), []byte("[")) {
+		loaded.Header = manifestHeader{MtimePrecision: "ns"}
+		err := json.Unmarshal(jsonBytes, &loaded.Entries)
+		return loaded, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(jsonBytes))
+	for line := 1; ; line++ {
+		var record struct {
+			Header  *manifestHeader  `json:"header"`
+			Entries []DigestInfo     `json:"entries"`
+			Trailer *manifestTrailer `json:"trailer"`
+		}
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return manifest{}, err
+		}
+		if err := json.Unmarshal(raw, &record); err != nil {
+			return manifest{}, fmt.Errorf("record %d: %v", line, err)
+		}
+		switch {
+		case record.Entries != nil: // json
+			loaded.Entries = append(loaded.Entries, record.Entries...)
+			if record.Header != nil {
+				loaded.Header = *record.Header
+			}
+			loaded.Trailer = record.Trailer
+		case record.Header != nil:
+			loaded.Header = *record.Header
+		case record.Trailer != nil:
+			loaded.Trailer = record.Trailer
+		default: // a jsonl entry
+			var info DigestInfo
+			if err := json.Unmarshal(raw, &info); err != nil {
+				return manifest{}, fmt.Errorf("record %d: %v", line, err)
+			}
+			loaded.Entries = append(loaded.Entries, info)
+		}
+	}
+	return loaded, nil
+}
+
+// manifestIndex: the entries of a manifest, by absolute path (as resolved by loadManifest)
+type manifestIndex struct {
+	entries   map[string]DigestInfo
+	precision time.Duration // of the manifest's modification times
+}
+
+func newManifestIndex(loaded manifest) manifestIndex {
+	index := manifestIndex{entries: map[string]DigestInfo{}, precision: time.Nanosecond}
+	if precision, err := parseMtimePrecision(loaded.Header.MtimePrecision); err == nil {
+		index.precision = precision
+	}
+	for _, info := range loaded.Entries {
+		index.entries[info.Name] = info
+	}
+	return index
+}
+
+// lookupDigest: the digest recorded for a file, if its size and modification time are unchanged
+// Only plain sha256 digests are reused (not sha256-merkle)
+// Modification times are compared at the manifest's precision
+func (index manifestIndex) lookupDigest(path string, info DigestInfo) (string, bool) {
+	if len(index.entries) == 0 {
+		return "", false
+	}
+	recorded, ok := index.entries[manifestRoot(path)]
+	if !ok || recorded.Sha256 == "" || recorded.Mode.IsDir() || recorded.DigestKind != "" {
+		return "", false
+	}
+	if recorded.Size != info.Size || !recorded.ModTime.Equal(info.ModTime.Truncate(index.precision)) {
+		return "", false
+	}
+	return recorded.Sha256, true
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadManifestMapPrefix(t *testing.T) {
+	var prefixes prefixMaps
+	if err := prefixes.Set("/volume1=/Volumes/Space"); err != nil {
+		t.Fatal(err)
+	}
+	manifests := map[string]string{
+		"relative": `{"header":{"root":"/volume1/Home-Movies","paths":"relative","mtime_precision":"s"},` +
+			`"entries":[{"name":"."},{"name":"Tapes/t1.mov","size":3}]}`,
+		"legacy": `[{"name":"/volume1/Home-Movies"},{"name":"/volume1/Home-Movies/Tapes/t1.mov","size":3}]`,
+	}
+	for kind, content := range manifests {
+		manifestPath := filepath.Join(t.TempDir(), "manifest.json")
+		if err := os.WriteFile(manifestPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := loadManifest(manifestPath, prefixes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index := newManifestIndex(loaded)
+		for _, path := range []string{"/Volumes/Space/Home-Movies", "/Volumes/Space/Home-Movies/Tapes/t1.mov"} {
+			if _, ok := index.entries[path]; !ok {
+				t.Errorf("%s: expected %s in %v", kind, path, index.entries)
+			}
+		}
+	}
+
+	// prefixes only match whole path components
+	for path, expected := range map[string]string{
+		"/volume1":    "/Volumes/Space",
+		"/volume1/a":  "/Volumes/Space/a",
+		"/volume10/a": "/volume10/a",
+		"/other/file": "/other/file",
+	} {
+		if mapped := prefixes.apply(path); mapped != expected {
+			t.Errorf("Expected %s => %s, got %s", path, expected, mapped)
+		}
+	}
+}
+
+func TestDecodeManifestJsonl(t *testing.T) {
+	header := `{"tool":"directory-digester","root":"/data","paths":"relative","mtime_precision":"ms"}`
+	entries := `{"name":"."},{"name":"a.txt","size":3,"sha256":"abc"}`
+	trailer := `{"files":1,"directories":1,"bytes":3,"root_sha256":"def"}`
+	encodings := map[string]string{
+		"json":  `{"header":` + header + `,"entries":[` + entries + `],"trailer":` + trailer + `}`,
+		"jsonl": `{"header":` + header + "}\n" + strings.ReplaceAll(entries, "},{", "}\n{") + "\n" + `{"trailer":` + trailer + "}\n",
+	}
+	for format, encoded := range encodings {
+		loaded, err := decodeManifest([]byte(encoded))
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if loaded.Header.Root != "/data" || loaded.Header.MtimePrecision != "ms" {
+			t.Errorf("%s: unexpected header %+v", format, loaded.Header)
+		}
+		if len(loaded.Entries) != 2 || loaded.Entries[1].Sha256 != "abc" {
+			t.Errorf("%s: unexpected entries %+v", format, loaded.Entries)
+		}
+		if loaded.Trailer == nil || loaded.Trailer.Files != 1 || loaded.Trailer.RootSha256 != "def" {
+			t.Errorf("%s: unexpected trailer %+v", format, loaded.Trailer)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// The metadata digest (meta_sha256) accounts for the name, size, permissions and modification time
+// of an entry, as well as its content digest: it is the digest of the entry's metaRecord (as JSON),
+// followed, for a directory, by the metadata digests of its children.
+// Timestamps are always UTC, and truncated to --mtime-precision, since filesystems store
+// different precisions (e.g. Synology vs APFS): digests from different hosts are then comparable.
+
+// mtimePrecision: modification times are truncated to this precision
+var mtimePrecision = time.Nanosecond
+
+// mtimePrecisions: the accepted values of --mtime-precision
+var mtimePrecisions = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"ns": time.Nanosecond,
+}
+
+// parseMtimePrecision: s, ms, us or ns
+func parseMtimePrecision(precision string) (time.Duration, error) {
+	if duration, ok := mtimePrecisions[precision]; ok {
+		return duration, nil
+	}
+	return 0, fmt.Errorf("unknown mtime precision %q (s, ms, us, ns)", precision)
+}
+
+// formatMtimePrecision: the name of a precision, as accepted by parseMtimePrecision
+func formatMtimePrecision(precision time.Duration) string {
+	for name, duration := range mtimePrecisions {
+		if duration == precision {
+			return name
+		}
+	}
+	return precision.String()
+}
+
+// normalizeModTime: the modification time in UTC, truncated to mtimePrecision
+func normalizeModTime(modTime time.Time) time.Time {
+	return modTime.UTC().Truncate(mtimePrecision)
+}
+
+// metaRecord: what the metadata digest of an entry accounts for, Name is the base name (maybe normalized)
+// The name on disk (raw_name) is not: copies normalized to the same names have the same metadata digests
+type metaRecord struct {
+	Name    string      `json:"name"`
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mod_time"`
+	Mode    os.FileMode `json:"mode"`
+	Uid     *uint32     `json:"uid,omitempty"`
+	Gid     *uint32     `json:"gid,omitempty"`
+	Sha256  string      `json:"sha256"`
+	// DigestKind and ChunkSize: how Sha256 was computed, empty for a plain sha256
+	DigestKind string `json:"digest_kind,omitempty"`
+	ChunkSize  int64  `json:"chunk_size,omitempty"`
+	// Xattrs: name: sha256 of the value, marshalled with sorted names
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+}
+
+// newMetaRecord: the mode is masked with --mode-mask, the owner and extended attributes only accounted for with --owner and --xattrs
+// Owner and group names are not accounted for: they depend on the host
+func newMetaRecord(node *DigestTreeNode) metaRecord {
+	record := metaRecord{
+		Name:       node.Info.Name,
+		Size:       node.Info.Size,
+		ModTime:    node.Info.ModTime,
+		Mode:       maskMode(node.Info.Mode),
+		Sha256:     node.Info.Sha256,
+		DigestKind: node.Info.DigestKind,
+		ChunkSize:  node.Info.ChunkSize,
+		Xattrs:     node.Info.Xattrs,
+	}
+	if node.Info.Owner != nil {
+		record.Uid, record.Gid = &node.Info.Owner.Uid, &node.Info.Owner.Gid
+	}
+	return record
+}
+
+// rootMetaName: the name in the metadata record of a tree's root, whatever the spelling of the root argument
+// (".", "rootDir01", or an absolute path): the same tree has the same root_meta_sha256 on every host
+const rootMetaName = "."
+
+// setRootMeta: recomputes the metadata digest of the root of a digested tree, named rootMetaName
+func setRootMeta(root *DigestTreeNode) error {
+	named := *root
+	named.Info.Name = rootMetaName
+	metaSha256, err := digestMeta(&named)
+	if err != nil {
+		return err
+	}
+	root.Info.MetaSha256 = metaSha256
+	return nil
+}
+
+// digestMeta: the metadata digest of a node, assumes the content digest (and the children's metadata digests) are known
+func digestMeta(node *DigestTreeNode) (string, error) {
+	recordJson, err := json.Marshal(newMetaRecord(node))
+	if err != nil {
+		return "", err
+	}
+	digester := sha256.New()
+	digester.Write(recordJson)
+	for _, child := range node.Children {
+		digester.Write([]byte(child.Info.MetaSha256))
+	}
+	return fmt.Sprintf("%x", digester.Sum(nil)), nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// digestTestTree: a directory with a single file, whose modification time is given
+func digestTestTree(t *testing.T, modTime time.Time) DigestTreeNode {
+	rootDirectory := filepath.Join(t.TempDir(), "root")
+	path := filepath.Join(rootDirectory, "file.txt")
+	if err := os.MkdirAll(rootDirectory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(rootDirectory, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	return digestTestDirectory(t, rootDirectory, 1)
+}
+
+// buildTestTree: the tree of an existing directory, not digested
+func buildTestTree(t *testing.T, rootDirectory string) DigestTreeNode {
+	rootInfo, err := os.Stat(rootDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootNode, err := buildTree(rootDirectory, rootInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rootNode
+}
+
+// digestTestDirectory: the tree of an existing directory, digested by workers
+func digestTestDirectory(t *testing.T, rootDirectory string, workers int) DigestTreeNode {
+	rootNode := buildTestTree(t, rootDirectory)
+	if err := digestTree(&rootNode, workers); err != nil {
+		t.Fatal(err)
+	}
+	return rootNode
+}
+
+func TestMtimePrecision(t *testing.T) {
+	defer func() { mtimePrecision = time.Nanosecond }()
+	// the same second and millisecond, as stored by two filesystems with different precisions
+	hostA := time.Date(2023, 3, 18, 14, 48, 4, 813_000_000, time.FixedZone("EDT", -4*3600))
+	hostB := time.Date(2023, 3, 18, 18, 48, 4, 813_456_789, time.UTC)
+
+	mtimePrecision = time.Nanosecond
+	treeA, treeB := digestTestTree(t, hostA), digestTestTree(t, hostB)
+	if treeA.Info.Sha256 != treeB.Info.Sha256 {
+		t.Fatalf("Expected the same content digest")
+	}
+	if treeA.Info.MetaSha256 == treeB.Info.MetaSha256 {
+		t.Errorf("Expected different metadata digests at ns precision")
+	}
+
+	mtimePrecision = time.Millisecond
+	treeA, treeB = digestTestTree(t, hostA), digestTestTree(t, hostB)
+	if treeA.Info.MetaSha256 != treeB.Info.MetaSha256 {
+		t.Errorf("Expected the same metadata digests at ms precision")
+	}
+	modTime := treeB.Children[0].Info.ModTime
+	if modTime.Location() != time.UTC || modTime.Nanosecond() != 813_000_000 {
+		t.Errorf("Expected a truncated UTC time, got %v", modTime)
+	}
+}
+
+func TestManifestIndexPrecision(t *testing.T) {
+	modTime := time.Date(2023, 3, 18, 18, 48, 4, 813_456_789, time.UTC)
+	loaded := manifest{
+		Header:  manifestHeader{MtimePrecision: "s", Timezone: "UTC"},
+		Entries: []DigestInfo{{Name: "/a/file.txt", Size: 7, ModTime: modTime.Truncate(time.Second), Sha256: "abc"}},
+	}
+	index := newManifestIndex(loaded)
+	if digest, ok := index.lookupDigest("/a/file.txt", DigestInfo{Size: 7, ModTime: modTime}); !ok || digest != "abc" {
+		t.Errorf("Expected the digest to be reused at the manifest's precision, got %q %v", digest, ok)
+	}
+	if _, ok := index.lookupDigest("/a/file.txt", DigestInfo{Size: 7, ModTime: modTime.Add(time.Second)}); ok {
+		t.Errorf("Expected a modified file not to reuse the digest")
+	}
+}
+
+func TestModeMask(t *testing.T) {
+	defer func() { modeMask, _ = parseModeMask("07777") }()
+	modTime := time.Date(2023, 3, 18, 18, 48, 4, 0, time.UTC)
+	file := digestTestTree(t, modTime).Children[0]
+	changed := file
+	changed.Info.Mode = 0600
+	if meta, _ := digestMeta(&changed); meta == file.Info.MetaSha256 {
+		t.Errorf("Expected a different metadata digest with another mode")
+	}
+	modeMask, _ = parseModeMask("0")
+	original, _ := digestMeta(&file)
+	if meta, _ := digestMeta(&changed); meta != original {
+		t.Errorf("Expected the same metadata digest with --mode-mask 0")
+	}
+	if mask, err := parseModeMask("4755"); err != nil || mask != os.ModeSetuid|0755 {
+		t.Errorf("Expected setuid|0755, got %v %v", mask, err)
+	}
+	if _, err := parseModeMask("0999"); err == nil {
+		t.Errorf("Expected an invalid mask")
+	}
+}
+
+func TestOwner(t *testing.T) {
+	defer func() { captureOwner = false }()
+	modTime := time.Date(2023, 3, 18, 18, 48, 4, 0, time.UTC)
+	testCases := []struct {
+		Name  string
+		Owner bool
+	}{
+		{"omitted", false},
+		{"captured", true},
+	}
+	metaSha256s := map[string]string{}
+	for _, tc := range testCases {
+		captureOwner = tc.Owner
+		file := digestTestTree(t, modTime).Children[0]
+		if !tc.Owner {
+			if file.Info.Owner != nil {
+				t.Errorf("%s: Expected no owner, got %+v", tc.Name, file.Info.Owner)
+			}
+			metaSha256s[tc.Name] = file.Info.MetaSha256
+			continue
+		}
+		if info, err := os.Stat(file.Path); err == nil {
+			if _, _, ok := fileOwner(info); !ok {
+				t.Skip("owners are not available on this platform")
+			}
+		}
+		if file.Info.Owner == nil || file.Info.Owner.Uid != uint32(os.Getuid()) || file.Info.Owner.Gid != uint32(os.Getgid()) {
+			t.Fatalf("%s: Expected uid %d and gid %d, got %+v", tc.Name, os.Getuid(), os.Getgid(), file.Info.Owner)
+		}
+		metaSha256s[tc.Name] = file.Info.MetaSha256
+		// another owner is another metadata digest
+		changed := file
+		changed.Info.Owner = &ownerInfo{Uid: file.Info.Owner.Uid + 1, Gid: file.Info.Owner.Gid}
+		if meta, _ := digestMeta(&changed); meta == file.Info.MetaSha256 {
+			t.Errorf("%s: Expected a different metadata digest with another uid", tc.Name)
+		}
+		// but not another owner name, which depends on the host
+		changed.Info.Owner = &ownerInfo{Uid: file.Info.Owner.Uid, Gid: file.Info.Owner.Gid, User: "someone-else"}
+		if meta, _ := digestMeta(&changed); meta != file.Info.MetaSha256 {
+			t.Errorf("%s: Expected the same metadata digest with another user name", tc.Name)
+		}
+	}
+	if metaSha256s["omitted"] == metaSha256s["captured"] {
+		t.Errorf("Expected --owner to change the metadata digest")
+	}
+}
+
+func TestRootMetaSpelling(t *testing.T) {
+	rootDirectory := filepath.Join(t.TempDir(), "root")
+	if err := os.MkdirAll(filepath.Join(rootDirectory, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	alias := filepath.Join(t.TempDir(), "alias")
+	if err := os.Symlink(rootDirectory, alias); err != nil {
+		t.Skip(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootDirectory, "file.txt"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the same directory, named "root" and "alias"
+	rootNode := digestTestDirectory(t, rootDirectory, 1)
+	respelled := digestTestDirectory(t, alias, 1)
+	if rootNode.Info.Name == respelled.Info.Name {
+		t.Fatalf("Expected two spellings, got %s twice", rootNode.Info.Name)
+	}
+	if rootNode.Info.MetaSha256 != respelled.Info.MetaSha256 {
+		t.Errorf("Expected the same root metadata digest as %s and %s, got %s and %s",
+			rootNode.Info.Name, respelled.Info.Name, rootNode.Info.MetaSha256, respelled.Info.MetaSha256)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BSD mtree(8) specification, as produced by `mtree -c -k type,mode,size,time,sha256digest`
+// Directory entries change the current directory, `..` goes back up,
+// and names are encoded with vis(3) octal escapes (white space, glob characters, #, non printable).
+
+// mtreeKeywordOrder: the keywords we produce, in the order we print them
+var mtreeKeywordOrder = []string{"type", "mode", "size", "time", "link", "sha256digest"}
+
+// mtreeEscape: encodes a name like strsvis(VIS_WHITE|VIS_OCTAL|VIS_GLOB) with "#" as an extra
+func mtreeEscape(name string) string {
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '\\':
+			sb.WriteString(`\\`)
+		case c <= ' ' || c >= 0x7f || strings.IndexByte("*?[#", c) >= 0:
+			fmt.Fprintf(&sb, "\\%03o", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// mtreeUnescape: decodes octal escapes (\ooo), and the common single character escapes
+func mtreeUnescape(name string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '\\' {
+			sb.WriteByte(name[i])
+			continue
+		}
+		if i+3 < len(name) && isOctal(name[i+1]) && isOctal(name[i+2]) && isOctal(name[i+3]) {
+			value, _ := strconv.ParseUint(name[i+1:i+4], 8, 8)
+			sb.WriteByte(byte(value))
+			i += 3
+			continue
+		}
+		if i+1 == len(name) {
+			return "", fmt.Errorf("invalid escape at end of %q", name)
+		}
+		i++
+		switch name[i] {
+		case '\\':
+			sb.WriteByte('\\')
+		case 's':
+			sb.WriteByte(' ')
+		case 't':
+			sb.WriteByte('\t')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		default:
+			return "", fmt.Errorf("invalid escape \\%c in %q", name[i], name)
+		}
+	}
+	return sb.String(), nil
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// mtreeType: the mtree type keyword for a file mode
+func mtreeType(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "dir"
+	case mode&os.ModeSymlink != 0:
+		return "link"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeCharDevice != 0:
+		return "char"
+	case mode&os.ModeDevice != 0:
+		return "block"
+	default:
+		return "file"
+	}
+}
+
+// mtreeMode: the unix permission bits of a file mode, including setuid, setgid and sticky
+func mtreeMode(mode os.FileMode) string {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return fmt.Sprintf("%#o", bits)
+}
+
+// mtreeKeywords: the mtree keywords describing a node
+// Only regular files have a size and digest: directory sizes are filesystem specific in mtree
+// The time is the one on disk, not truncated to --mtime-precision, as mtree -f compares it exactly
+func mtreeKeywords(node DigestTreeNode) map[string]string {
+	modTime := node.ModTime
+	if modTime.IsZero() { // read from a manifest
+		modTime = node.Info.ModTime
+	}
+	keywords := map[string]string{
+		"type": mtreeType(node.Info.Mode),
+		"mode": mtreeMode(node.Info.Mode),
+		"time": fmt.Sprintf("%d.%09d", modTime.Unix(), modTime.Nanosecond()),
+	}
+	switch keywords["type"] {
+	case "file":
+		keywords["size"] = strconv.FormatInt(node.Info.Size, 10)
+		if node.Info.Sha256 != "" { // absent in inventories
+			keywords["sha256digest"] = node.Info.Sha256
+		}
+	case "link":
+		if target, err := os.Readlink(node.Path); err == nil {
+			keywords["link"] = mtreeEscape(target)
+		}
+	}
+	return keywords
+}
+
+func formatMtreeKeywords(keywords map[string]string) string {
+	var parts []string
+	for _, keyword := range mtreeKeywordOrder {
+		if value, ok := keywords[keyword]; ok {
+			parts = append(parts, keyword+"="+value)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// showTreeAsMtree: prints the tree as an mtree specification
+func showTreeAsMtree(node DigestTreeNode) {
+	writeMtree(os.Stdout, node)
+}
+
+func writeMtree(w io.Writer, root DigestTreeNode) {
+	userName := "unknown"
+	if u, err := user.Current(); err == nil {
+		userName = u.Username
+	}
+	treePath, err := filepath.Abs(root.Path)
+	if err != nil {
+		treePath = root.Path
+	}
+	fmt.Fprintf(w, "#\t   user: %s\n", userName)
+	fmt.Fprintf(w, "#\tmachine: %s\n", getHostname())
+	fmt.Fprintf(w, "#\t   tree: %s\n", treePath)
+	fmt.Fprintf(w, "#\t   date: %s\n", time.Now().Format(time.ANSIC))
+	writeMtreeDirectory(w, root, ".", 0)
+}
+
+// writeMtreeDirectory: like mtree -c, files are listed before sub-directories
+// Names are those on disk (not normalized with --normalize), so that the specification matches the tree
+func writeMtreeDirectory(w io.Writer, dir DigestTreeNode, relPath string, depth int) {
+	indent := strings.Repeat("    ", depth)
+	name := "."
+	if depth > 0 {
+		name = mtreeEscape(filepath.Base(dir.Path))
+	}
+	fmt.Fprintf(w, "\n# %s\n", mtreeEscape(relPath))
+	fmt.Fprintf(w, "%s%-15s %s\n", indent, name, formatMtreeKeywords(mtreeKeywords(dir)))
+	for _, child := range dir.Children {
+		if !child.Info.Mode.IsDir() {
+			fmt.Fprintf(w, "%s    %-11s %s\n", indent, mtreeEscape(filepath.Base(child.Path)), formatMtreeKeywords(mtreeKeywords(child)))
+		}
+	}
+	for _, child := range dir.Children {
+		if child.Info.Mode.IsDir() {
+			writeMtreeDirectory(w, child, relPath+"/"+filepath.Base(child.Path), depth+1)
+		}
+	}
+	if depth > 0 {
+		fmt.Fprintf(w, "# %s\n%s..\n\n", mtreeEscape(relPath), indent)
+	}
+}
+
+// mtreeEntry: one entry of a parsed specification, Path is relative to the root, starting with "."
+type mtreeEntry struct {
+	Path     string
+	Keywords map[string]string
+}
+
+// parseMtree: parses an mtree specification, handling /set, /unset, `..` and full path entries
+func parseMtree(r io.Reader) ([]mtreeEntry, error) {
+	var entries []mtreeEntry
+	defaults := map[string]string{}
+	var cwd []string // the current directory, as a stack of names
+	haveRoot := false
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	var continued string
+	for scanner.Scan() {
+		lineNumber++
+		line := continued + scanner.Text()
+		continued = ""
+		if strings.HasSuffix(line, "\\") && !strings.HasSuffix(line, "\\\\") {
+			continued = strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch fields[0] {
+		case "/set":
+			for _, field := range fields[1:] {
+				keyword, value, _ := strings.Cut(field, "=")
+				defaults[keyword] = value
+			}
+			continue
+		case "/unset":
+			for _, keyword := range fields[1:] {
+				if keyword == "all" {
+					defaults = map[string]string{}
+				}
+				delete(defaults, keyword)
+			}
+			continue
+		case "..":
+			if len(cwd) == 0 {
+				return nil, fmt.Errorf("line %d: `..` above the root", lineNumber)
+			}
+			cwd = cwd[:len(cwd)-1]
+			continue
+		}
+
+		name, err := mtreeUnescape(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		keywords := map[string]string{}
+		for keyword, value := range defaults {
+			keywords[keyword] = value
+		}
+		for _, field := range fields[1:] {
+			keyword, value, _ := strings.Cut(field, "=")
+			keywords[keyword] = value
+		}
+
+		var path string
+		switch {
+		case strings.Contains(name, "/"):
+			// full path entries do not change the current directory
+			path = "./" + strings.TrimPrefix(filepath.ToSlash(filepath.Clean(name)), "./")
+			if filepath.Clean(name) == "." {
+				path = "."
+			}
+		case name == "." && !haveRoot:
+			path = "."
+			haveRoot = true
+		default:
+			path = strings.Join(append([]string{"."}, append(cwd, name)...), "/")
+			if keywords["type"] == "dir" {
+				cwd = append(cwd, name)
+			}
+		}
+		entries = append(entries, mtreeEntry{Path: path, Keywords: keywords})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// mtreeRelPath: the path of a node as found in a specification: "." for the root, "./name" below
+func mtreeRelPath(rootPath string, nodePath string) string {
+	relPath, err := filepath.Rel(rootPath, nodePath)
+	if err != nil || relPath == "." {
+		return "."
+	}
+	return "./" + filepath.ToSlash(relPath)
+}
+
+// mtreeKeywordLabels: the descriptions used when reporting differences, as mtree -f does
+var mtreeKeywordLabels = map[string]string{
+	"type":         "type",
+	"mode":         "permissions",
+	"size":         "size",
+	"time":         "modification time",
+	"link":         "link",
+	"sha256digest": "sha256digest",
+}
+
+// compareMtreeEntry: the differences between a specification entry and a node,
+// only the keywords present in the specification are compared
+func compareMtreeEntry(entry mtreeEntry, node DigestTreeNode) []string {
+	actual := mtreeKeywords(node)
+	var differences []string
+	for _, keyword := range mtreeKeywordOrder {
+		expected, ok := entry.Keywords[keyword]
+		if !ok {
+			continue
+		}
+		found := actual[keyword]
+		same := expected == found
+		switch keyword {
+		case "mode":
+			expectedBits, err1 := strconv.ParseUint(expected, 8, 32)
+			foundBits, err2 := strconv.ParseUint(found, 8, 32)
+			same = err1 == nil && err2 == nil && expectedBits == foundBits
+		case "time":
+			same = sameMtreeTime(expected, found)
+		case "sha256digest":
+			same = strings.EqualFold(expected, found)
+		}
+		if !same {
+			differences = append(differences, fmt.Sprintf("%s expected %s found %s", mtreeKeywordLabels[keyword], expected, found))
+		}
+	}
+	return differences
+}
+
+// sameMtreeTime: compares sec.nsec times, a missing or shorter fraction is zero padded
+func sameMtreeTime(expected, found string) bool {
+	normalize := func(t string) string {
+		seconds, fraction, _ := strings.Cut(t, ".")
+		return seconds + "." + (fraction + "000000000")[:9]
+	}
+	return normalize(expected) == normalize(found)
+}
+
+// collectMtreeNodes: indexes the nodes of the tree by their specification path
+func collectMtreeNodes(rootPath string, node DigestTreeNode, nodes map[string]DigestTreeNode, order *[]string) {
+	relPath := mtreeRelPath(rootPath, node.Path)
+	nodes[relPath] = node
+	*order = append(*order, relPath)
+	for _, child := range node.Children {
+		collectMtreeNodes(rootPath, child, nodes, order)
+	}
+}
+
+// checkMtree: validates the tree at rootDirectory against a specification, like mtree -f spec -p root
+// Prints the differences and returns true if there were none
+func checkMtree(specPath string, rootDirectory string, workers int) (bool, error) {
+	defer bypassXattrCache()()
+	specFile, err := os.Open(specPath)
+	if err != nil {
+		return false, err
+	}
+	defer specFile.Close()
+	entries, err := parseMtree(specFile)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", specPath, err)
+	}
+
+	rootInfo, err := os.Stat(rootDirectory)
+	if err != nil {
+		return false, err
+	}
+	rootNode, err := buildTree(rootDirectory, rootInfo)
+	if err != nil {
+		return false, err
+	}
+	if err := digestTree(&rootNode, workers); err != nil {
+		return false, err
+	}
+
+	nodes := map[string]DigestTreeNode{}
+	var order []string
+	collectMtreeNodes(rootDirectory, rootNode, nodes, &order)
+
+	ok := true
+	inSpec := map[string]bool{}
+	for _, entry := range entries {
+		inSpec[entry.Path] = true
+		node, found := nodes[entry.Path]
+		if !found {
+			fmt.Printf("%s missing\n", mtreeEscape(entry.Path))
+			ok = false
+			continue
+		}
+		differences := compareMtreeEntry(entry, node)
+		if len(differences) > 0 {
+			ok = false
+			fmt.Printf("%s changed\n", mtreeEscape(entry.Path))
+			for _, difference := range differences {
+				fmt.Printf("\t%s\n", difference)
+			}
+		}
+	}
+
+	var extras []string
+	for _, relPath := range order {
+		if !inSpec[relPath] {
+			extras = append(extras, relPath)
+		}
+	}
+	sort.Strings(extras)
+	for _, relPath := range extras {
+		fmt.Printf("extra: %s\n", mtreeEscape(relPath))
+		ok = false
+	}
+	if *verboseFlag {
+		log.Printf("checkMtree(%s) entries: %d extra: %d ok: %v\n", specPath, len(entries), len(extras), ok)
+	}
+	return ok, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMtreeEscapeRoundTrip(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		Escaped string
+	}{
+		{"plain.txt", "plain.txt"},
+		{"with space", `with\040space`},
+		{"#hash*glob?[x]", `\043hash\052glob\077\133x]`},
+		{`back\slash`, `back\\slash`},
+		{"caf\xc3\xa9", `caf\303\251`},
+	}
+	for _, tc := range testCases {
+		escaped := mtreeEscape(tc.Name)
+		if escaped != tc.Escaped {
+			t.Errorf("Expected %q to escape to %q, but got %q", tc.Name, tc.Escaped, escaped)
+		}
+		unescaped, err := mtreeUnescape(escaped)
+		if err != nil {
+			t.Fatalf("Error unescaping %q: %v", escaped, err)
+		}
+		if unescaped != tc.Name {
+			t.Errorf("Expected %q to unescape to %q, but got %q", escaped, tc.Name, unescaped)
+		}
+	}
+}
+
+func TestParseMtree(t *testing.T) {
+	spec := `#	   user: daniel
+
+/set type=file mode=0644
+.               type=dir mode=0755
+    AA.txt      size=30
+# ./sub\040dir
+sub\040dir      type=dir mode=0755
+    inner.txt   size=22 \
+                sha256digest=abc
+..
+./full/path.txt size=1
+`
+	entries, err := parseMtree(strings.NewReader(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		Path     string
+		Keyword  string
+		Expected string
+	}{
+		{".", "type", "dir"},
+		{"./AA.txt", "mode", "0644"},
+		{"./sub dir", "type", "dir"},
+		{"./sub dir/inner.txt", "sha256digest", "abc"},
+		{"./full/path.txt", "size", "1"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d entries, got %d: %v", len(expected), len(entries), entries)
+	}
+	for i, e := range expected {
+		if entries[i].Path != e.Path || entries[i].Keywords[e.Keyword] != e.Expected {
+			t.Errorf("Expected %s %s=%s, but got %s %v", e.Path, e.Keyword, e.Expected, entries[i].Path, entries[i].Keywords)
+		}
+	}
+}
+
+func TestMtreeNormalizedNames(t *testing.T) {
+	rootDirectory := t.TempDir()
+	// names on disk in NFD, digested with --normalize nfc
+	directory := filepath.Join(rootDirectory, "e\u0301te\u0301")
+	if err := os.Mkdir(directory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(directory, "E\u0301cole"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { nameNormalization = "" }()
+	nameNormalization = "nfc"
+
+	var spec strings.Builder
+	writeMtree(&spec, digestTestDirectory(t, rootDirectory, 1))
+	if !strings.Contains(spec.String(), mtreeEscape("E\u0301cole")) {
+		t.Errorf("Expected the specification to hold the name on disk, but got:\n%s", spec.String())
+	}
+	specPath := filepath.Join(t.TempDir(), "spec.mtree")
+	if err := os.WriteFile(specPath, []byte(spec.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ok, err := checkMtree(specPath, rootDirectory, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Errorf("Expected the tree to match its own specification")
+	}
+}
+
+func TestMtreeTimeOnDisk(t *testing.T) {
+	rootDirectory := t.TempDir()
+	path := filepath.Join(rootDirectory, "file.txt")
+	if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Unix(1700000000, 123456789)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { mtimePrecision = time.Nanosecond }()
+	mtimePrecision = time.Second
+
+	var spec strings.Builder
+	writeMtree(&spec, digestTestDirectory(t, rootDirectory, 1))
+	if !strings.Contains(spec.String(), "time=1700000000.123456789") {
+		t.Errorf("Expected the specification to hold the time on disk, but got:\n%s", spec.String())
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// File names are arbitrary bytes, but encoding/json replaces invalid UTF-8 with U+FFFD:
+// two distinct names could then collide in a manifest, and could not be mapped back to disk.
+// Such names are also emitted losslessly, as base64 of their bytes, in a raw_name field.
+// The same field holds the name on disk when the emitted name was normalized (see normalizeName).
+
+// rawNameIfChanged: the base64 encoding of the name on disk, if it is not valid UTF-8 or not emitted as is
+func rawNameIfChanged(onDisk string, emitted string) string {
+	if onDisk == emitted && utf8.ValidString(onDisk) {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(onDisk))
+}
+
+// restoreRawName: the DigestInfo with its original Name, when a raw name was recorded
+func restoreRawName(info DigestInfo) (DigestInfo, error) {
+	if info.RawName == "" {
+		return info, nil
+	}
+	name, err := base64.StdEncoding.DecodeString(info.RawName)
+	if err != nil {
+		return info, err
+	}
+	info.Name = string(name)
+	info.RawName = ""
+	return info, nil
+}
+
+// File names may be stored in different Unicode normalization forms on different systems
+// (NFD-ish on macOS, NFC on Linux/Synology), which changes both the names and their sort order,
+// and therefore the directory digests. Names can be normalized before sorting and digesting.
+
+// nameNormalization: "" (names are used as is), "nfc" or "nfd"
+var nameNormalization = ""
+
+// checkNameNormalization: "", nfc or nfd
+func checkNameNormalization(normalization string) error {
+	switch normalization {
+	case "", "nfc", "nfd":
+		return nil
+	}
+	return fmt.Errorf("unknown --normalize %q (nfc, nfd)", normalization)
+}
+
+// normalizeName: the name in the selected normalization form; invalid UTF-8 is left untouched
+func normalizeName(name string) string {
+	if !utf8.ValidString(name) {
+		return name
+	}
+	switch nameNormalization {
+	case "nfc":
+		return norm.NFC.String(name)
+	case "nfd":
+		return norm.NFD.String(name)
+	}
+	return name
+}
+
+// sortChildrenByName: children in the order of their (normalized) names
+// Without normalization, this is the os.ReadDir order: the raw bytes of the names
+func sortChildrenByName(node *DigestTreeNode) {
+	sort.SliceStable(node.Children, func(i, j int) bool {
+		return node.Children[i].Info.Name < node.Children[j].Info.Name
+	})
+}
+
+// nameCollision: distinct names of a directory with the same normalized form
+type nameCollision struct {
+	Directory  string
+	Normalized string
+	Names      []string
+}
+
+// findNameCollisions: the collisions in every directory of the tree, for the given form (nfc or nfd)
+func findNameCollisions(node DigestTreeNode, form norm.Form) []nameCollision {
+	var collisions []nameCollision
+	byNormalized := map[string][]string{}
+	var order []string
+	for _, child := range node.Children {
+		_, name := filepath.Split(child.Path) // the name on disk, not the normalized Info.Name
+		normalized := name
+		if utf8.ValidString(name) {
+			normalized = form.String(name)
+		}
+		if _, ok := byNormalized[normalized]; !ok {
+			order = append(order, normalized)
+		}
+		byNormalized[normalized] = append(byNormalized[normalized], name)
+	}
+	for _, normalized := range order {
+		if len(byNormalized[normalized]) > 1 {
+			collisions = append(collisions, nameCollision{
+				Directory:  node.Path,
+				Normalized: normalized,
+				Names:      byNormalized[normalized],
+			})
+		}
+	}
+	for _, child := range node.Children {
+		if child.Info.Mode.IsDir() {
+			collisions = append(collisions, findNameCollisions(child, form)...)
+		}
+	}
+	return collisions
+}
+
+// lintNamesCommand: reference lint-names [--normalize nfc|nfd] <directory>
+// Reports names of a directory which collide once normalized, exits with status 1 if there are any
+func lintNamesCommand(args []string) error {
+	flags := flag.NewFlagSet("lint-names", flag.ExitOnError)
+	flags.BoolVar(verboseFlag, "verbose", false, "verbose output")
+	normalize := flags.String("normalize", "nfc", "normalization form used to compare names: nfc or nfd")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: lint-names [flags] <directory>")
+	}
+	form := norm.NFC
+	switch *normalize {
+	case "nfc":
+	case "nfd":
+		form = norm.NFD
+	default:
+		return fmt.Errorf("unknown --normalize %q (nfc, nfd)", *normalize)
+	}
+	rootDirectory := flags.Arg(0)
+
+	rootInfo, err := os.Stat(rootDirectory)
+	if err != nil {
+		return err
+	}
+	rootNode, err := buildTree(rootDirectory, rootInfo)
+	if err != nil {
+		return err
+	}
+	collisions := findNameCollisions(rootNode, form)
+	for _, collision := range collisions {
+		fmt.Printf("%s: %d names normalize to %q:", collision.Directory, len(collision.Names), collision.Normalized)
+		for _, name := range collision.Names {
+			fmt.Printf(" %+q", name)
+		}
+		fmt.Println()
+	}
+	if len(collisions) > 0 {
+		return errInvalid
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+func TestRawNameManifestRoundTrip(t *testing.T) {
+	rootDirectory := t.TempDir()
+	// both names would be "Schr�dinger" after encoding/json
+	names := []string{"Schr\xf6dinger", "Schr\xfcdinger", "Schrödinger"}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(rootDirectory, name), []byte(name), 0644); err != nil {
+			t.Skipf("filesystem does not accept name %q: %v", name, err)
+		}
+	}
+
+	rootInfo, err := os.Stat(rootDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootNode, err := buildTree(rootDirectory, rootInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := digestTree(&rootNode, 1); err != nil {
+		t.Fatal(err)
+	}
+	var list []DigestInfo
+	convertTreeToListWithPath(rootNode, rootDirectory, rootDirectory, &list)
+	jsonBytes, err := json.Marshal(manifest{Header: newManifestHeader(rootDirectory, time.Now()), Entries: list})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestPath := filepath.Join(t.TempDir(), "manifest.json")
+	if err := os.WriteFile(manifestPath, jsonBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadManifest(manifestPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := newManifestIndex(loaded)
+	if len(index.entries) != len(names)+1 {
+		t.Fatalf("Expected %d distinct paths, got %d", len(names)+1, len(index.entries))
+	}
+	for _, name := range names {
+		path := filepath.Join(rootDirectory, name)
+		info, ok := index.entries[path]
+		if !ok {
+			t.Errorf("Expected %q in the loaded manifest", path)
+			continue
+		}
+		if _, err := os.Stat(info.Name); err != nil {
+			t.Errorf("Expected %q to map back to disk: %v", info.Name, err)
+		}
+	}
+}
+
+func TestNormalizeNames(t *testing.T) {
+	rootDirectory := t.TempDir()
+	// "É" sorts before "Z" when decomposed (E + U+0301), after it when composed (U+00C9)
+	names := []string{"\u00c9cole", "Zebra", "\u00e9t\u00e9", "e\u0301te\u0301"}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(rootDirectory, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() { nameNormalization = "" }()
+
+	testCases := []struct {
+		Normalization string
+		Expected      []string
+	}{
+		{"nfc", []string{"Zebra", "\u00c9cole", "\u00e9t\u00e9", "\u00e9t\u00e9"}},
+		{"nfd", []string{"E\u0301cole", "Zebra", "e\u0301te\u0301", "e\u0301te\u0301"}},
+	}
+	for _, tc := range testCases {
+		nameNormalization = tc.Normalization
+		rootInfo, err := os.Stat(rootDirectory)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rootNode, err := buildTree(rootDirectory, rootInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, child := range rootNode.Children {
+			if child.Info.Name != tc.Expected[i] {
+				t.Errorf("%s: expected child %d to be %+q, but got %+q", tc.Normalization, i, tc.Expected[i], child.Info.Name)
+			}
+			if _, err := os.Stat(child.Path); err != nil {
+				t.Errorf("%s: expected the path to remain the one on disk: %v", tc.Normalization, err)
+			}
+		}
+
+		collisions := findNameCollisions(rootNode, norm.NFC)
+		if len(collisions) != 1 || len(collisions[0].Names) != 2 {
+			t.Errorf("Expected one collision of two names, got %v", collisions)
+		}
+	}
+}
+
+func TestNormalizedMetaDigests(t *testing.T) {
+	defer func() { nameNormalization = "" }()
+	nameNormalization = "nfc"
+	modTime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	// the same tree, with its names on disk in NFC, then in NFD
+	digestForm := func(form norm.Form) DigestTreeNode {
+		rootDirectory := filepath.Join(t.TempDir(), "root")
+		directory := filepath.Join(rootDirectory, form.String("été"))
+		path := filepath.Join(directory, form.String("École"))
+		if err := os.MkdirAll(directory, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []string{path, directory, rootDirectory} {
+			if err := os.Chtimes(p, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return digestTestDirectory(t, rootDirectory, 1)
+	}
+	nfc, nfd := digestForm(norm.NFC), digestForm(norm.NFD)
+	if nfc.Info.MetaSha256 != nfd.Info.MetaSha256 {
+		t.Errorf("Expected the same metadata digest in NFC and NFD, got %s and %s", nfc.Info.MetaSha256, nfd.Info.MetaSha256)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+)
+
+// Ownership and permissions, as they matter for metadata digests:
+// the owner is only captured with --owner (unix), and --mode-mask selects the mode bits
+// that are digested, so that a copy with different permissions (e.g. docker mounted) can still match.
+
+// captureOwner: set by --owner
+var captureOwner = false
+
+// modeMask: the permission bits (including setuid, setgid and sticky) accounted for by metadata digests
+var modeMask os.FileMode = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// ownerInfo: numeric owner and group, and their names when they can be resolved on this host
+type ownerInfo struct {
+	Uid   uint32 `json:"uid"`
+	Gid   uint32 `json:"gid"`
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+}
+
+// ownerNames: cache of resolved user and group names, lookups may read /etc/passwd or query a directory service
+var ownerNames = struct {
+	sync.Mutex
+	users  map[uint32]string
+	groups map[uint32]string
+}{users: map[uint32]string{}, groups: map[uint32]string{}}
+
+// newOwnerInfo: the owner of a file, nil unless --owner was given and the platform supports it
+func newOwnerInfo(info fs.FileInfo) *ownerInfo {
+	if !captureOwner {
+		return nil
+	}
+	uid, gid, ok := fileOwner(info)
+	if !ok {
+		return nil
+	}
+	ownerNames.Lock()
+	defer ownerNames.Unlock()
+	userName, ok := ownerNames.users[uid]
+	if !ok {
+		if u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err == nil {
+			userName = u.Username
+		}
+		ownerNames.users[uid] = userName
+	}
+	groupName, ok := ownerNames.groups[gid]
+	if !ok {
+		if g, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10)); err == nil {
+			groupName = g.Name
+		}
+		ownerNames.groups[gid] = groupName
+	}
+	return &ownerInfo{Uid: uid, Gid: gid, User: userName, Group: groupName}
+}
+
+// parseModeMask: an octal unix mask (e.g. 0755, 07777, or 0 to ignore permissions) as os.FileMode bits
+func parseModeMask(mask string) (os.FileMode, error) {
+	bits, err := strconv.ParseUint(mask, 8, 32)
+	if err != nil || bits > 07777 {
+		return 0, fmt.Errorf("invalid mode mask %q (octal, at most 07777)", mask)
+	}
+	mode := os.FileMode(bits) & os.ModePerm
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
+// formatModeMask: the mask as octal, as accepted by parseModeMask
+func formatModeMask(mask os.FileMode) string {
+	return mtreeMode(mask)
+}
+
+// maskMode: the mode with the permission bits outside of modeMask cleared, the type bits are kept
+func maskMode(mode os.FileMode) os.FileMode {
+	permissionBits := os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	return mode&^permissionBits | mode&modeMask
+}
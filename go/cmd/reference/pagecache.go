@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+)
+
+// Page cache aware reading (linux): repeated runs on the same host measure RAM, not disk,
+// and a full archive scrub evicts everything else from the page cache.
+//   --fadvise after: posix_fadvise(DONTNEED) once a file is hashed, so a scrub does not fill the page cache
+//   --fadvise evict: also before reading it, so that it is read from disk (honest benchmarks)
+//   --cache-report: counts the bytes of each file which were resident before it was read (mincore),
+//     that is the bytes likely served from the page cache
+
+// fadviseMode: "" (none), "after" or "evict"
+var fadviseMode = ""
+
+// cacheReport: set by --cache-report
+var cacheReport = false
+
+// cachedBytes: bytes which were resident in the page cache before they were read
+var cachedBytes atomic.Int64
+
+var errPageCacheUnsupported = errors.New("page cache control is only supported on linux (amd64, arm64)")
+
+// beforeRead: evicts the file with --fadvise evict, then counts its resident bytes with --cache-report
+// (dirty pages cannot be dropped, they are still served from the page cache)
+func beforeRead(file *os.File) error {
+	if !cacheReport && fadviseMode != "evict" {
+		return nil
+	}
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	if fadviseMode == "evict" {
+		if err := dropPageCache(file); err != nil {
+			return err
+		}
+	}
+	if cacheReport {
+		resident, err := residentBytes(file, info.Size())
+		if err != nil {
+			return err
+		}
+		cachedBytes.Add(resident)
+	}
+	return nil
+}
+
+// afterRead: drops the file's pages from the page cache, with --fadvise after or evict
+func afterRead(file *os.File) error {
+	if fadviseMode == "" {
+		return nil
+	}
+	return dropPageCache(file)
+}
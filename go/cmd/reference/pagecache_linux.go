@@ -0,0 +1,58 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const pageCacheSupported = true
+
+// residentWindow: files are mapped (and their pages counted) a window at a time, to bound the mincore vector
+const residentWindow = 1024 * 1024 * 1024
+
+// dropPageCache: posix_fadvise(fd, 0, 0, POSIX_FADV_DONTNEED), clean pages of the whole file are dropped
+func dropPageCache(file *os.File) error {
+	const fadviseDontNeed = 4 // POSIX_FADV_DONTNEED
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, file.Fd(), 0, 0, fadviseDontNeed, 0, 0)
+	if errno != 0 {
+		return os.NewSyscallError("fadvise64", errno)
+	}
+	return nil
+}
+
+// residentBytes: how much of the file is in the page cache, according to mincore
+func residentBytes(file *os.File, size int64) (int64, error) {
+	pageSize := int64(os.Getpagesize())
+	var resident int64
+	for offset := int64(0); offset < size; offset += residentWindow {
+		length := size - offset
+		if length > residentWindow {
+			length = residentWindow
+		}
+		mapped, err := syscall.Mmap(int(file.Fd()), offset, int(length), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err != nil {
+			return 0, os.NewSyscallError("mmap", err)
+		}
+		pages := make([]byte, (length+pageSize-1)/pageSize)
+		_, _, errno := syscall.Syscall(syscall.SYS_MINCORE,
+			uintptr(unsafe.Pointer(&mapped[0])), uintptr(length), uintptr(unsafe.Pointer(&pages[0])))
+		syscall.Munmap(mapped)
+		if errno != 0 {
+			return 0, os.NewSyscallError("mincore", errno)
+		}
+		for i, page := range pages {
+			if page&1 == 0 {
+				continue
+			}
+			if i == len(pages)-1 && length%pageSize != 0 {
+				resident += length % pageSize
+			} else {
+				resident += pageSize
+			}
+		}
+	}
+	return resident, nil
+}
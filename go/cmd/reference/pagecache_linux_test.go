@@ -0,0 +1,39 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPageCache(t *testing.T) {
+	defer func() { fadviseMode, cacheReport = "", false }()
+	path := filepath.Join(t.TempDir(), "file")
+	// freshly written pages are dirty: resident, and not dropped by fadvise
+	if err := os.WriteFile(path, make([]byte, 5000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	resident, err := residentBytes(file, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resident != 5000 {
+		t.Errorf("Expected the whole file (including its last partial page) to be resident, got %d", resident)
+	}
+
+	fadviseMode, cacheReport = "evict", true
+	cachedBytes.Store(0)
+	if _, err := digestFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if cached := cachedBytes.Load(); cached < 0 || cached > 5000 {
+		t.Errorf("Expected at most the size of the file to be counted, got %d", cached)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !(linux && (amd64 || arm64))
+
+package main
+
+import "os"
+
+const pageCacheSupported = false
+
+func dropPageCache(file *os.File) error {
+	return errPageCacheUnsupported
+}
+
+func residentBytes(file *os.File, size int64) (int64, error) {
+	return 0, errPageCacheUnsupported
+}
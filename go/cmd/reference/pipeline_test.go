@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"testing"
+)
+
+// failingReader: returns its data, then an error
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("read error")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// failingWriter: accepts limit bytes, then fails
+type failingWriter struct {
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, errors.New("write error")
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func TestCopyPipelined(t *testing.T) {
+	defer func(saved int) { readBufferSize = saved }(readBufferSize)
+	data := bytes.Repeat([]byte("0123456789"), 100_000) // not a multiple of the buffer size
+	expected := sha256.Sum256(data)
+	for _, size := range []int{0, 64 * 1024, 1024 * 1024, 4 * 1024 * 1024} {
+		readBufferSize = size
+		digester := sha256.New()
+		n, err := copyPipelined(digester, bytes.NewReader(data))
+		if err != nil || n != int64(len(data)) || !bytes.Equal(digester.Sum(nil), expected[:]) {
+			t.Errorf("buffer size %d: expected the same digest as io.Copy, got n=%d err=%v", size, n, err)
+		}
+	}
+
+	readBufferSize = 64 * 1024
+	n, err := copyPipelined(io.Discard, &failingReader{data: data[:100_000]})
+	if err == nil || n != 100_000 {
+		t.Errorf("Expected the read error after 100000 bytes, got n=%d err=%v", n, err)
+	}
+
+	// a failed write stops the copy, whatever the buffer size
+	for _, size := range []int{0, 64 * 1024} {
+		readBufferSize = size
+		n, err := copyPipelined(&failingWriter{limit: 100_000}, bytes.NewReader(data))
+		if err == nil || n > 100_000 {
+			t.Errorf("buffer size %d: expected the write error, got n=%d err=%v", size, n, err)
+		}
+	}
+
+	for size, expected := range map[string]int{"0": 0, "65536": 65536, "512KiB": 512 * 1024, "16MiB": 16 * 1024 * 1024} {
+		if parsed, err := parseBufferSize(size); err != nil || parsed != expected {
+			t.Errorf("Expected %s to be %d bytes, got %d %v", size, expected, parsed, err)
+		}
+	}
+	for _, size := range []string{"32KiB", "128MiB", "1GB", "-1"} {
+		if _, err := parseBufferSize(size); err == nil {
+			t.Errorf("Expected %s to be rejected", size)
+		}
+	}
+	for size, expected := range map[int64]string{0: "0", 1000: "1000", 512 * 1024: "512KiB", 1536 * 1024: "1536KiB", 1 << 30: "1GiB"} {
+		if formatted := formatByteSize(size); formatted != expected {
+			t.Errorf("Expected %d bytes to be formatted as %s, got %s", size, expected, formatted)
+		}
+	}
+}
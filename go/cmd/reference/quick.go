@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Quick digests (--quick): an approximate digest, to tell whether anything obviously changed without reading everything.
+// The quick digest of a file is the sha256 of its size, the sample size N and the number of samples K
+// (as big-endian uint64), followed by N-byte regions of the file, in order: its first N bytes,
+// K samples starting at i*(size-N)/(K+1) for i = 1..K (evenly spaced between the first and last N bytes),
+// and its last N bytes. A file of at most (K+2)*N bytes is hashed whole instead, after the same prefix.
+// Quick digests are labelled sha256-quick (entries, directories, and the header's algorithm): they are never
+// equal to a full digest, and are not reused as one (dupes --manifest, dedup-estimate).
+
+// quickDigestKind: the digest kind of quick digests, see DigestInfo.DigestKind
+const quickDigestKind = "sha256-quick"
+
+var (
+	// quickDigest: --quick
+	quickDigest bool
+	// quickSize: N, the size of the head, the tail, and each sample (--quick-size)
+	quickSize int64 = 1024 * 1024
+	// quickSamples: K, the number of samples between the head and the tail (--quick-samples)
+	quickSamples int
+)
+
+// parseQuickSize: a byte size of at least 4KiB
+func parseQuickSize(size string) (int64, error) {
+	bytes, err := parseByteSize(size)
+	if err != nil {
+		return 0, fmt.Errorf("invalid quick size %q (e.g. 1MiB)", size)
+	}
+	if bytes < 4*1024 {
+		return 0, fmt.Errorf("quick size %q out of range (at least 4KiB)", size)
+	}
+	return bytes, nil
+}
+
+// quickRegions: the offsets of the regions of a file (of sampleSize bytes) hashed by a quick digest, in order
+// nil when the file is hashed whole
+func quickRegions(size int64, sampleSize int64, samples int) []int64 {
+	if size <= int64(samples+2)*sampleSize {
+		return nil
+	}
+	offsets := []int64{0}
+	tail := size - sampleSize
+	for i := 1; i <= samples; i++ {
+		offsets = append(offsets, tail*int64(i)/int64(samples+1))
+	}
+	return append(offsets, tail)
+}
+
+// digestFileQuick: the quick digest of a file (as hex)
+func digestFileQuick(path string, sampleSize int64, samples int) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := info.Size()
+
+	digester := sha256.New()
+	for _, value := range []int64{size, sampleSize, int64(samples)} {
+		binary.Write(digester, binary.BigEndian, uint64(value))
+	}
+	offsets := quickRegions(size, sampleSize, samples)
+	if offsets == nil {
+		if _, err := copyPipelined(digester, file); err != nil {
+			return "", err
+		}
+	}
+	for _, offset := range offsets {
+		n, err := copyPipelined(digester, io.NewSectionReader(file, offset, sampleSize))
+		if err != nil {
+			return "", err
+		}
+		if n != sampleSize {
+			return "", fmt.Errorf("%s: at offset %d: %w", path, offset, io.ErrUnexpectedEOF)
+		}
+	}
+	return fmt.Sprintf("%x", digester.Sum(nil)), nil
+}
+
+// digestQuickNode: digests a file with a quick digest
+func digestQuickNode(node *DigestTreeNode) error {
+	start := time.Now()
+	digest, err := digestFileQuick(node.Path, quickSize, quickSamples)
+	if err != nil {
+		return err
+	}
+	node.Info.DigestKind = quickDigestKind
+	return setLeafDigest(node, digest, start)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQuickRegions(t *testing.T) {
+	for _, test := range []struct {
+		size     int64
+		samples  int
+		expected []int64
+	}{
+		{size: 2048, samples: 0, expected: nil},
+		{size: 2049, samples: 0, expected: []int64{0, 1025}},
+		{size: 4096, samples: 2, expected: nil},
+		{size: 10240, samples: 3, expected: []int64{0, 2304, 4608, 6912, 9216}},
+	} {
+		if offsets := quickRegions(test.size, 1024, test.samples); fmt.Sprint(offsets) != fmt.Sprint(test.expected) {
+			t.Errorf("size %d, %d samples: expected %v, got %v", test.size, test.samples, test.expected, offsets)
+		}
+	}
+}
+
+func TestQuickDigest(t *testing.T) {
+	defer func() { quickDigest = false }()
+	quickDigest = true
+	rootDirectory := t.TempDir()
+	path := filepath.Join(rootDirectory, "file")
+	data := make([]byte, 5*quickSize)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	before := digestTestDirectory(t, rootDirectory, 1)
+	file := before.Children[0].Info
+	if before.Info.DigestKind != quickDigestKind || file.DigestKind != quickDigestKind {
+		t.Errorf("Expected sha256-quick digests, got %q and %q", before.Info.DigestKind, file.DigestKind)
+	}
+	if file.Sha256 == fmt.Sprintf("%x", sha256.Sum256(data)) {
+		t.Errorf("Expected a quick digest to differ from the full digest")
+	}
+
+	// a change between the head and the tail goes unnoticed, unless it is sampled
+	data[2*quickSize+quickSize/2] = 1
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if after := digestTestDirectory(t, rootDirectory, 1); after.Children[0].Info.Sha256 != file.Sha256 {
+		t.Errorf("Expected the middle of the file not to be hashed")
+	}
+	defer func() { quickSamples = 0 }()
+	quickSamples = 1
+	sampled, err := digestFileQuick(path, quickSize, quickSamples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[2*quickSize+quickSize/2] = 0
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if restored, err := digestFileQuick(path, quickSize, quickSamples); err != nil || restored == sampled {
+		t.Errorf("Expected the sample to notice the change, got %v", err)
+	}
+}
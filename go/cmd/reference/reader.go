@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"sync"
+)
+
+// Reader backends (--reader): std opens, reads and closes each file with its own syscalls.
+// For many small files (audiobooks with thousands of chapter files), that per-file overhead dominates:
+// uring (linux, amd64 and arm64) batches the opens, reads and closes of small files (at most uringMaxFileSize)
+// through io_uring, with raw syscalls. Other files are read by std.
+// The backend falls back to std when io_uring is not available, or with --xattr-cache, --fadvise or --cache-report.
+
+// readerBackend: std or uring
+var readerBackend = "std"
+
+// uringMaxFileSize: the largest file read whole by the uring backend, in a buffer of its own
+const uringMaxFileSize = 1024 * 1024
+
+// uringFallback: the fallback to std is logged once
+var uringFallback sync.Once
+
+func fallbackToStd(reason string) {
+	uringFallback.Do(func() {
+		log.Printf("--reader uring: %s, using the std reader\n", reason)
+	})
+}
+
+// useUring: whether the uring backend applies to this run
+func useUring() bool {
+	if readerBackend != "uring" {
+		return false
+	}
+	if !uringSupported {
+		fallbackToStd("io_uring is only supported on linux (amd64, arm64)")
+		return false
+	}
+	if useXattrCache || fadviseMode != "" || cacheReport {
+		fallbackToStd("not combined with --xattr-cache, --fadvise or --cache-report")
+		return false
+	}
+	return true
+}
+
+// digestDevice: digests the nodes of a device with the selected backend and workers
+// Returns one error per node, in order
+func digestDevice(device uint64, nodes []*DigestTreeNode, workers int) []error {
+	if useUring() {
+		var small, other []int
+		for i, node := range nodes {
+			if node.Info.Mode.IsRegular() && node.Info.Size <= uringMaxFileSize && !quickDigest && !isChunked(node) && !isContentChunked(node) {
+				small = append(small, i)
+			} else {
+				other = append(other, i)
+			}
+		}
+		smallNodes := make([]*DigestTreeNode, len(small))
+		for i, index := range small {
+			smallNodes[i] = nodes[index]
+		}
+		hashers := workers
+		if hashers == autoWorkers {
+			hashers = runtime.NumCPU()
+		}
+		smallErrs, err := digestSmallFilesUring(smallNodes, hashers)
+		if err == nil {
+			otherNodes := make([]*DigestTreeNode, len(other))
+			for i, index := range other {
+				otherNodes[i] = nodes[index]
+			}
+			otherErrs := digestDeviceStd(device, otherNodes, workers)
+			errs := make([]error, len(nodes))
+			for i, index := range small {
+				errs[index] = smallErrs[i]
+			}
+			for i, index := range other {
+				errs[index] = otherErrs[i]
+			}
+			return errs
+		}
+		// the ring could not be set up: nothing was digested yet
+		fallbackToStd(err.Error())
+	}
+	return digestDeviceStd(device, nodes, workers)
+}
+
+// digestDeviceStd: digests the nodes of a device with the std reader, with a pool of workers or adaptive
+func digestDeviceStd(device uint64, nodes []*DigestTreeNode, workers int) []error {
+	if workers == autoWorkers {
+		return digestDeviceAdaptive(device, nodes)
+	}
+	return runParallel(len(nodes), workers, func(i int) error {
+		return digestNode(nodes[i])
+	})
+}
@@ -3,9 +3,9 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"io/fs"
 	"log"
 	"os"
@@ -31,34 +31,55 @@ type DigestTreeNode struct {
 	Path     string
 	Info     DigestInfo
 	Children []DigestTreeNode
+	Device   uint64    // of the filesystem holding the file, 0 when unknown (see fileIdentity)
+	ModTime  time.Time // on disk, before normalizeModTime, zero when unknown (see mtree.go)
 }
 
 // This is likely the structure that will be serialized to JSON
 // There is a question of whether the full path (from root of our tree) should be used
 // for now, we are using Name (basename of Path), which appropriate for recursive display (with indentation)
 // TODO(daneroo): rename mod_time to mtime
+// RawName is only set when Name is not the name on disk: invalid UTF-8 or normalized (see names.go)
 type DigestInfo struct {
 	Name    string      `json:"name"`
+	RawName string      `json:"raw_name,omitempty"`
 	Size    int64       `json:"size"`
 	ModTime time.Time   `json:"mod_time"`
 	Mode    os.FileMode `json:"mode"`
-	Sha256  string      `json:"sha256"`
+	Sha256  string      `json:"sha256,omitempty"` // absent in inventories (see inventory.go)
+	// DigestKind is empty for a plain sha256 of the content, see chunked.go for sha256-merkle, quick.go for sha256-quick
+	DigestKind string `json:"digest_kind,omitempty"`
+	// ChunkSize and Chunks (the sha256 of each chunk) are only set for sha256-merkle digests
+	ChunkSize int64    `json:"chunk_size,omitempty"`
+	Chunks    []string `json:"chunks,omitempty"`
+	// ContentChunks are only recorded with --cdc-size, for files of more than one chunk (see cdc.go)
+	ContentChunks []contentChunk `json:"content_chunks,omitempty"`
+	// Owner is only captured with --owner
+	Owner *ownerInfo `json:"owner,omitempty"`
+	// Xattrs is only captured with --xattrs: the sha256 of the value of each extended attribute, by name
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+	// MetaSha256 also accounts for name, size, mode and mod_time (see metadata.go)
+	MetaSha256 string `json:"meta_sha256,omitempty"`
 }
 
 func newDigestInfo(info fs.FileInfo) DigestInfo {
 	return DigestInfo{
-		Name:    info.Name(),
+		Name:    normalizeName(info.Name()),
 		Size:    info.Size(), // not used for directories, will be replaced by sum of children
-		ModTime: info.ModTime(),
+		ModTime: normalizeModTime(info.ModTime()),
 		Mode:    info.Mode(),
+		Owner:   newOwnerInfo(info),
 		// Sha256:  "",
 	}
 }
 
 func newLeaf(path string, info fs.FileInfo) DigestTreeNode {
+	device, _, _ := fileIdentity(info)
 	return DigestTreeNode{
-		Path: path,
-		Info: newDigestInfo(info),
+		Path:    path,
+		Info:    newDigestInfo(info),
+		Device:  device,
+		ModTime: info.ModTime(),
 	}
 }
 
@@ -72,40 +93,65 @@ func setSizeOfParent(node *DigestTreeNode) {
 	node.Info.Size = size
 }
 
+// setLeafDigest: sets the digest of a leaf, once its content is digested, and its metadata digest
+func setLeafDigest(node *DigestTreeNode, digest string, start time.Time) error {
+	node.Info.Sha256 = digest
+	metaSha256, err := digestMeta(node)
+	if err != nil {
+		return err
+	}
+	node.Info.MetaSha256 = metaSha256
+
+	elapsed := time.Since(start).Seconds()
+	sizeMB := float64(node.Info.Size) / 1024 / 1024
+	rate := sizeMB / elapsed
+
+	if *verboseFlag {
+		log.Printf("digestNode(%s) = %s (leaf) - size: %.2fMB elapsed: %.2fs rate: %.2f MB/s\n",
+			node.Path, node.Info.Sha256, sizeMB, elapsed, rate)
+	}
+	return nil
+}
+
 // digestNode: calculates the digest of a node
 // This can be invoked on a leaf node, or a directory node.
 // On the directory it is assumed that the children have been previously digested
 func digestNode(node *DigestTreeNode) error {
-	digester := sha256.New()
+	if quickDigest && !node.Info.Mode.IsDir() {
+		return digestQuickNode(node)
+	}
+	if isChunked(node) {
+		return digestChunkedNode(node)
+	}
+	if isContentChunked(node) {
+		return digestContentChunkedNode(node)
+	}
 	if !node.Info.Mode.IsDir() {
 		start := time.Now()
 
 		// Calculate the sha256 digest of the file
-		file, err := os.Open(node.Path)
+		digest, err := digestFileCached(node.Path)
 		if err != nil {
 			return err
 		}
-		defer file.Close()
-
-		if _, err := io.Copy(digester, file); err != nil {
-			return err
-		}
-		node.Info.Sha256 = fmt.Sprintf("%x", digester.Sum(nil))
-
-		elapsed := time.Since(start).Seconds()
-		sizeMB := float64(node.Info.Size) / 1024 / 1024
-		rate := sizeMB / elapsed
-
-		if *verboseFlag {
-			log.Printf("digestNode(%s) = %s (leaf) - size: %.2fMB elapsed: %.2fs rate: %.2f MB/s\n",
-				node.Path, node.Info.Sha256, sizeMB, elapsed, rate)
-		}
+		return setLeafDigest(node, digest, start)
 	} else {
 		// Calculate the sha256 digest of the children
+		// Children are in os.ReadDir order: sorted by the raw bytes of their names, whatever their encoding
+		digester := sha256.New()
 		for _, child := range node.Children {
 			digester.Write([]byte(child.Info.Sha256))
 		}
 		node.Info.Sha256 = fmt.Sprintf("%x", digester.Sum(nil))
+		// the digest of a directory is as approximate as its children's
+		if quickDigest {
+			node.Info.DigestKind = quickDigestKind
+		}
+		metaSha256, err := digestMeta(node)
+		if err != nil {
+			return err
+		}
+		node.Info.MetaSha256 = metaSha256
 		if *verboseFlag {
 			log.Printf("digestNode(%s) = %s (node)\n", node.Path, node.Info.Sha256)
 		}
@@ -113,8 +159,10 @@ func digestNode(node *DigestTreeNode) error {
 	return nil
 }
 
+// ignorePatterns: names skipped by buildTree
+var ignorePatterns = []string{".DS_Store", "@eaDir"}
+
 func ignoreName(name string) bool {
-	ignorePatterns := []string{".DS_Store", "@eaDir"}
 	for _, pattern := range ignorePatterns {
 		if match, _ := filepath.Match(pattern, name); match {
 			return true
@@ -161,6 +209,9 @@ func buildTree(parentPath string, parentInfo fs.FileInfo) (DigestTreeNode, error
 		log.Printf("buildTree(%s)\n", parentPath)
 	}
 	parentNode := newLeaf(parentPath, parentInfo)
+	if err := setXattrs(&parentNode); err != nil {
+		return DigestTreeNode{}, err
+	}
 
 	// The children of the node we are building : could be empty (dir)
 	// ioutil.ReadDir is deprecated, so we use os.ReadDir instead as suggested
@@ -190,10 +241,9 @@ func buildTree(parentPath string, parentInfo fs.FileInfo) (DigestTreeNode, error
 
 		var node DigestTreeNode
 		if !file.IsDir() { // not a directory, so leaf node
+			// the digest of the leaf node is deferred to digestTree
 			node = newLeaf(path, info)
-			// digest of the leaf node
-			err = digestNode(&node)
-			if err != nil {
+			if err := setXattrs(&node); err != nil {
 				return DigestTreeNode{}, err
 			}
 		} else { // directory, so recurse
@@ -204,15 +254,56 @@ func buildTree(parentPath string, parentInfo fs.FileInfo) (DigestTreeNode, error
 		}
 		parentNode.Children = append(parentNode.Children, node)
 	}
-	// This is where we can aggregate the size and digest of the children
-	setSizeOfParent(&parentNode)
-	err = digestNode(&parentNode)
-	if err != nil {
-		return DigestTreeNode{}, err
+	if nameNormalization != "" {
+		sortChildrenByName(&parentNode)
 	}
+	// This is where we can aggregate the size of the children
+	setSizeOfParent(&parentNode)
 	return parentNode, nil
 }
 
+// digestTree: digests all the leaves of the tree with the parallel hashing engine,
+// then digests the directories bottom-up, once all their children are digested
+// The root's metadata digest does not account for its name (see setRootMeta)
+func digestTree(root *DigestTreeNode, workers int) error {
+	var leaves []*DigestTreeNode
+	collectLeaves(root, &leaves)
+	for _, err := range digestLeaves(leaves, workers) {
+		if err != nil {
+			return err
+		}
+	}
+	if err := digestDirectories(root); err != nil {
+		return err
+	}
+	return setRootMeta(root)
+}
+
+// collectLeaves: appends pointers to the leaf nodes of the tree, in traversal order
+// The tree must not be modified while these pointers are in use
+func collectLeaves(node *DigestTreeNode, leaves *[]*DigestTreeNode) {
+	if !node.Info.Mode.IsDir() {
+		*leaves = append(*leaves, node)
+		return
+	}
+	for i := range node.Children {
+		collectLeaves(&node.Children[i], leaves)
+	}
+}
+
+// digestDirectories: digests the directory nodes (post-order), assumes the leaves are digested
+func digestDirectories(node *DigestTreeNode) error {
+	if !node.Info.Mode.IsDir() {
+		return nil
+	}
+	for i := range node.Children {
+		if err := digestDirectories(&node.Children[i]); err != nil {
+			return err
+		}
+	}
+	return digestNode(node)
+}
+
 func shortDigest(digest string, maxLength int) string {
 	if len(digest) > maxLength {
 		return digest[:(maxLength/2)] + ".." + digest[len(digest)-(maxLength/2):]
@@ -244,26 +335,37 @@ func showAsIndented(node DigestTreeNode, depth int, maxLength int) {
 	if node.Info.Mode.IsDir() {
 		isDirIndicator = "/" //fmt.Sprintf("/ (%d)", len(node.Children))
 	}
-	fmt.Printf("%s%-*s%s - %10d bytes digest:%s\n", pad, maxLength-depth*2, node.Info.Name, isDirIndicator, node.Info.Size, shortDigest(node.Info.Sha256, 16))
+	kind := "digest" // or the digest kind, e.g. sha256-quick
+	if node.Info.DigestKind != "" {
+		kind = node.Info.DigestKind
+	}
+	digest := " " + kind + ":" + shortDigest(node.Info.Sha256, 16)
+	if node.Info.Sha256 == "" { // inventory
+		digest = ""
+	}
+	fmt.Printf("%s%-*s%s - %10d bytes%s\n", pad, maxLength-depth*2, node.Info.Name, isDirIndicator, node.Info.Size, digest)
 	for _, child := range node.Children {
 		showAsIndented(child, depth+1, maxLength)
 	}
 }
 
-func convertTreeToListWithPath(node DigestTreeNode, list *[]DigestInfo) {
+// convertTreeToListWithPath: Name holds the path relative to root (see manifestEntryPath)
+func convertTreeToListWithPath(node DigestTreeNode, root string, absoluteRoot string, list *[]DigestInfo) {
+	path := manifestEntryPath(root, absoluteRoot, node.Path)
 	nameAsPathInfo := node.Info
-	nameAsPathInfo.Name = node.Path
+	nameAsPathInfo.Name = normalizeName(path)
+	nameAsPathInfo.RawName = rawNameIfChanged(path, nameAsPathInfo.Name)
 	*list = append(*list, nameAsPathInfo)
 	for _, child := range node.Children {
-		convertTreeToListWithPath(child, list)
+		convertTreeToListWithPath(child, root, absoluteRoot, list)
 	}
 }
 
-func showTreeAsJson(node DigestTreeNode) error {
+func showTreeAsJson(node DigestTreeNode, header manifestHeader, trailer manifestTrailer) error {
 	var list []DigestInfo
-	convertTreeToListWithPath(node, &list)
+	convertTreeToListWithPath(node, node.Path, header.Root, &list)
 	// jsonBytes, err := json.MarshalIndent(list, "", "  ")
-	jsonBytes, err := json.Marshal(list)
+	jsonBytes, err := json.Marshal(manifest{Header: header, Entries: list, Trailer: &trailer})
 	if err != nil {
 		return err
 	}
@@ -271,33 +373,215 @@ func showTreeAsJson(node DigestTreeNode) error {
 	return nil
 }
 
+// showTreeAsJsonl: one record per line: the header, each entry, then the trailer
+func showTreeAsJsonl(node DigestTreeNode, header manifestHeader, trailer manifestTrailer) error {
+	var list []DigestInfo
+	convertTreeToListWithPath(node, node.Path, header.Root, &list)
+	encoder := json.NewEncoder(os.Stdout)
+	if err := encoder.Encode(map[string]manifestHeader{"header": header}); err != nil {
+		return err
+	}
+	for _, info := range list {
+		if err := encoder.Encode(info); err != nil {
+			return err
+		}
+	}
+	return encoder.Encode(map[string]manifestTrailer{"trailer": trailer})
+}
+
 // make this global so we can use it all over the place
 var verboseFlag = flag.Bool("verbose", false, "verbose output")
 
+// errInvalid: returned by commands when a verification found problems (they have already been printed)
+var errInvalid = errors.New("verification failed")
+
+// commands: reference <command> [flags] [args], each command parses its own flags
+var commands = map[string]func(args []string) error{
+	"bag":            bagCommand,
+	"validate-bag":   validateBagCommand,
+	"dupes":          dupesCommand,
+	"dedupe":         dedupeCommand,
+	"lint-names":     lintNamesCommand,
+	"check-xattrs":   checkXattrsCommand,
+	"check-chunks":   checkChunksCommand,
+	"cdc-diff":       cdcDiffCommand,
+	"dedup-estimate": dedupEstimateCommand,
+	"upgrade":        upgradeCommand,
+	"bench-report":   benchReportCommand,
+	"selftest-bench": selftestBenchCommand,
+}
+
 func main() {
 	logsetup.SetupFormat()
 
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			err := command(os.Args[2:])
+			if errors.Is(err, errInvalid) {
+				os.Exit(1)
+			}
+			if err != nil {
+				log.Fatalf("%s: %v\n", os.Args[1], err)
+			}
+			return
+		}
+	}
+
 	// cli flags
 	// --verbose is global
-	var jsonFlag = flag.Bool("json", false, "json output")
+	var jsonFlag = flag.Bool("json", false, "json output (same as --format json)")
+	var formatFlag = flag.String("format", "text", "output format: text, json, jsonl, sha256sum, mtree")
+	var checkFlag = flag.String("check", "", "verify against a sha256sum file (as sha256sum -c), or an mtree spec with --format mtree (as mtree -f)")
+	workers := workersValue(1)
+	flag.Var(&workers, "workers", "number of files digested in parallel, or auto (adapts to each device)")
+	workersFlag := (*int)(&workers)
+	flag.StringVar(&nameNormalization, "normalize", "", "normalize names to nfc or nfd before sorting and digesting")
+	var mtimePrecisionFlag = flag.String("mtime-precision", "ns", "truncate modification times to s, ms, us or ns")
+	flag.BoolVar(&captureOwner, "owner", false, "capture uid/gid (and user/group names), included in metadata digests")
+	flag.BoolVar(&captureXattrs, "xattrs", false, "capture extended attributes (linux), included in metadata digests")
+	flag.Var(&xattrInclude, "xattr-include", "only capture extended attributes matching this pattern (repeatable)")
+	flag.Var(&xattrExclude, "xattr-exclude", "do not capture extended attributes matching this pattern (repeatable)")
+	flag.BoolVar(&useXattrCache, "xattr-cache", false, "store file digests in user.dd.* extended attributes (linux), and reuse them when unchanged")
+	flag.BoolVar(&absolutePaths, "absolute-paths", false, "json: absolute paths, instead of paths relative to the root recorded in the header")
+	var resultsFlag = flag.String("results", "", "append a benchmark record (JSON line) to this file, see bench-report")
+	var labelFlag = flag.String("label", "", "dataset label of the benchmark record (default: the root's base name)")
+	var cacheFlag = flag.String("cache-state", "unknown", "page cache state of the benchmark record: cold, warm or unknown")
+	flag.StringVar(&fadviseMode, "fadvise", "", "drop files from the page cache (linux): after hashing them, or evict (before and after)")
+	flag.BoolVar(&cacheReport, "cache-report", false, "report the bytes likely served from the page cache (linux, mincore)")
+	var bufferSizeFlag = flag.String("buffer-size", "0", "read buffer size (64KiB to 64MiB), reads overlap with hashing; 0 reads 32KiB at a time without overlap")
+	flag.StringVar(&readerBackend, "reader", "std", "reader backend: std, or uring (linux: batches small files through io_uring)")
+	var chunkSizeFlag = flag.String("chunk-size", "0", "digest files larger than this in chunks, hashed in parallel (sha256-merkle, e.g. 64MiB); 0 disables")
+	var cdcSizeFlag = flag.String("cdc-size", "0", "record the content-defined chunks (FastCDC) of each file, of this average size (e.g. 1MiB); 0 disables")
+	flag.BoolVar(&quickDigest, "quick", false, "approximate digests (sha256-quick): the size, the first and last --quick-size bytes, and --quick-samples between them")
+	var quickSizeFlag = flag.String("quick-size", "1MiB", "--quick: size of the head, the tail and each sample")
+	flag.IntVar(&quickSamples, "quick-samples", 0, "--quick: number of samples, evenly spaced between the head and the tail")
+	flag.BoolVar(&inventoryMode, "inventory", false, "metadata only (tree, sizes, timestamps), without opening files; see upgrade")
+	var modeMaskFlag = flag.String("mode-mask", "07777", "octal mask applied to the mode before metadata digesting (0 ignores permissions)")
 	flag.Parse()
 
-	hostname := getHostname()
-	runtime := getRuntime()
+	mask, err := parseModeMask(*modeMaskFlag)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	modeMask = mask
+	if (captureXattrs || useXattrCache) && !xattrsSupported {
+		log.Fatalf("--xattrs, --xattr-cache: %v\n", errXattrsUnsupported)
+	}
+
+	bufferSize, err := parseBufferSize(*bufferSizeFlag)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	readBufferSize = bufferSize
+
+	chunkSize, err = parseChunkSize(*chunkSizeFlag)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+
+	cdcSize, err = parseCdcSize(*cdcSizeFlag)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if cdcSize > 0 && chunkSize > 0 {
+		log.Fatalf("--cdc-size and --chunk-size can not be combined\n")
+	}
+
+	quickSize, err = parseQuickSize(*quickSizeFlag)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if quickSamples < 0 {
+		log.Fatalf("--quick-samples must not be negative\n")
+	}
+	if quickDigest && (chunkSize > 0 || cdcSize > 0 || useXattrCache || fadviseMode != "" || cacheReport) {
+		log.Fatalf("--quick can not be combined with --chunk-size, --cdc-size, --xattr-cache, --fadvise or --cache-report\n")
+	}
+
+	switch readerBackend {
+	case "std", "uring":
+	default:
+		log.Fatalf("unknown --reader %q (std, uring)\n", readerBackend)
+	}
+
+	switch fadviseMode {
+	case "", "after", "evict":
+	default:
+		log.Fatalf("unknown --fadvise %q (after, evict)\n", fadviseMode)
+	}
+	if (fadviseMode != "" || cacheReport) && !pageCacheSupported {
+		log.Fatalf("--fadvise, --cache-report: %v\n", errPageCacheUnsupported)
+	}
+	// evicted files are read from disk
+	if fadviseMode == "evict" && *cacheFlag == "unknown" {
+		*cacheFlag = "cold"
+	}
+	switch *cacheFlag {
+	case "cold", "warm", "unknown":
+	default:
+		log.Fatalf("unknown --cache-state %q (cold, warm, unknown)\n", *cacheFlag)
+	}
+
+	precision, err := parseMtimePrecision(*mtimePrecisionFlag)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	mtimePrecision = precision
+
+	if err := checkNameNormalization(nameNormalization); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+
+	format := *formatFlag
+	if *jsonFlag {
+		format = "json"
+	}
+	switch format {
+	case "text", "json", "jsonl", "sha256sum", "mtree":
+	default:
+		log.Fatalf("unknown --format %q (text, json, jsonl, sha256sum, mtree)\n", format)
+	}
+	if inventoryMode && (format == "sha256sum" || *checkFlag != "" || quickDigest || chunkSize > 0 || cdcSize > 0 ||
+		useXattrCache || fadviseMode != "" || cacheReport) {
+		log.Fatalf("--inventory: not supported with --format sha256sum, --check, --quick, --chunk-size, --cdc-size, --xattr-cache, --fadvise or --cache-report\n")
+	}
+	// sha256sum and mtree only hold plain sha256 digests
+	if (chunkSize > 0 || quickDigest) && (format == "sha256sum" || format == "mtree" || *checkFlag != "") {
+		log.Fatalf("--chunk-size, --quick: not supported with --format sha256sum or mtree, or --check\n")
+	}
 
 	// Define the directory to walk recursively
 	rootDirectory := "/Users/daniel/Downloads"
 	if flag.NArg() > 0 {
 		rootDirectory = flag.Arg(0)
 	}
+
+	if *checkFlag != "" {
+		var ok bool
+		var err error
+		if format == "mtree" {
+			ok, err = checkMtree(*checkFlag, rootDirectory, *workersFlag)
+		} else {
+			ok, err = checkSha256sum(*checkFlag, *workersFlag)
+		}
+		if err != nil {
+			log.Fatalf("check %s: %v\n", *checkFlag, err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// These two lines are printed to stderr even if !verboseFlag
 	// TODO(daneroo) add a silent flag to suppress even these
-	log.Printf("directory-digester %s - commit:%s - build:%s - runtime:%s\n", version, commit, buildDate, runtime)
+	log.Printf("directory-digester %s - commit:%s - build:%s - runtime:%s\n", version, commit, buildDate, getRuntime())
 
 	log.Printf("directory-digester start root: %s\n", rootDirectory)
 
 	// TODO(daneroo) replace with newDigestInfo()
 	start := time.Now()
+	header := newManifestHeader(manifestRoot(rootDirectory), start)
 
 	rootInfo, err := os.Stat(rootDirectory)
 	if err != nil {
@@ -307,25 +591,52 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	if !inventoryMode {
+		err = digestTree(&rootNode, *workersFlag)
+		if err != nil {
+			panic(err)
+		}
+	}
 
-	elapsed := time.Since(start).Seconds()
-	totalSizeMB := float64(rootNode.Info.Size) / 1024 / 1024
-	rate := totalSizeMB / elapsed
+	trailer := newManifestTrailer(&rootNode, start)
+	totalSizeMB := float64(trailer.Bytes) / 1024 / 1024
 
 	log.Printf("directory-digester done  root: %s files: %d - size: %.2fMB  elapsed:  %.2fs rate: %.2f MB/s\n",
 		rootNode.Info.Name,
-		len(rootNode.Children),
+		trailer.Files,
 		totalSizeMB,
-		elapsed,
-		rate)
+		trailer.ElapsedSeconds,
+		trailer.RateMBps)
+	if cacheReport {
+		log.Printf("page cache: %.2fMB of %.2fMB were likely served from the page cache\n", float64(trailer.CachedBytes)/1024/1024, totalSizeMB)
+	}
+	if useXattrCache {
+		log.Printf("xattr cache: reused: %d - stored: %d\n", xattrCacheReused.Load(), xattrCacheStored.Load())
+	}
+	if *resultsFlag != "" {
+		label := *labelFlag
+		if label == "" {
+			label = filepath.Base(header.Root)
+		}
+		if err := appendBenchRecord(*resultsFlag, newBenchRecord(header, trailer, label, *workersFlag, *cacheFlag)); err != nil {
+			log.Fatalf("--results: %v\n", err)
+		}
+	}
 	// now as markdown (stderr)
 	fmt.Fprintf(os.Stderr, "| Machine | Runtime | Time (s) |  Data (MB) | Rate (MB/s) |\n")
 	fmt.Fprintf(os.Stderr, "|:--------|:-----|---------:|-----------:|------------:|\n")
-	fmt.Fprintf(os.Stderr, "| %s | %s | %.2f | %.2f | %.2f |\n", hostname, runtime, elapsed, totalSizeMB, rate)
-
-	if *jsonFlag {
-		showTreeAsJson(rootNode)
-	} else {
+	fmt.Fprintf(os.Stderr, "| %s | %s | %.2f | %.2f | %.2f |\n", header.Host, header.Runtime, trailer.ElapsedSeconds, totalSizeMB, trailer.RateMBps)
+
+	switch format {
+	case "json":
+		showTreeAsJson(rootNode, header, trailer)
+	case "jsonl":
+		showTreeAsJsonl(rootNode, header, trailer)
+	case "sha256sum":
+		showTreeAsSha256sum(rootNode)
+	case "mtree":
+		showTreeAsMtree(rootNode)
+	default:
 		showAsIndented(rootNode, 0, 0)
 	}
 }
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// selftest-bench: where is the bottleneck on this host, CPU (digest) or I/O?
+// It measures, in turn:
+//   - hashing throughput from memory, per algorithm and per number of goroutines
+//   - raw sequential read throughput from a directory, per --buffer-size (through the read pipeline), without hashing
+//   - the combined rate (read and sha256), per number of workers
+// and recommends a worker count and a buffer size.
+// The files are read more than once: every pass starts cold where the page cache can be dropped (linux),
+// and warm elsewhere (after a first, unmeasured, pass).
+
+// selftestAlgorithms: the algorithms whose hashing throughput is measured, sha256 is the one we use
+var selftestAlgorithms = []struct {
+	Name string
+	New  func() hash.Hash
+}{
+	{"sha256", sha256.New},
+	{"sha512", sha512.New},
+	{"sha1", sha1.New},
+	{"md5", md5.New},
+}
+
+// selftestBufferSizes: the --buffer-size values which are measured, 0 reads 32KiB at a time (io.Copy)
+var selftestBufferSizes = []int{0, 256 * 1024, 1024 * 1024, 4 * 1024 * 1024, 16 * 1024 * 1024}
+
+// selftestWorkerCounts: 1, 2, 4... up to max
+func selftestWorkerCounts(max int) []int {
+	var counts []int
+	for count := 1; count < max; count *= 2 {
+		counts = append(counts, count)
+	}
+	return append(counts, max)
+}
+
+// rateMBps: throughput in MB/s
+func rateMBps(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) / 1024 / 1024 / elapsed.Seconds()
+}
+
+// measureHashing: MB/s of goroutines each hashing the same in-memory block, for about duration
+func measureHashing(newHash func() hash.Hash, goroutines int, duration time.Duration) float64 {
+	block := make([]byte, 1024*1024)
+	for i := range block {
+		block[i] = byte(i * 7)
+	}
+	var total atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			digester := newHash()
+			for time.Since(start) < duration {
+				digester.Write(block)
+				total.Add(int64(len(block)))
+			}
+			digester.Sum(nil)
+		}()
+	}
+	wg.Wait()
+	return rateMBps(total.Load(), time.Since(start))
+}
+
+// selftestFiles: the files of a directory, in traversal order, until maxBytes
+func selftestFiles(directory string, maxBytes int64) ([]string, int64, error) {
+	rootInfo, err := os.Stat(directory)
+	if err != nil {
+		return nil, 0, err
+	}
+	rootNode, err := buildTree(directory, rootInfo)
+	if err != nil {
+		return nil, 0, err
+	}
+	var leaves []*DigestTreeNode
+	collectLeaves(&rootNode, &leaves)
+	var paths []string
+	var total int64
+	for _, leaf := range leaves {
+		if total >= maxBytes {
+			break
+		}
+		if !leaf.Info.Mode.IsRegular() {
+			continue
+		}
+		paths = append(paths, leaf.Path)
+		total += leaf.Info.Size
+	}
+	return paths, total, nil
+}
+
+// readFileWith: reads a file through the read pipeline, into dst
+func readFileWith(path string, dst io.Writer) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return copyPipelined(dst, file)
+}
+
+// evictFiles: drops the files from the page cache, so that they are read from disk again
+func evictFiles(paths []string) error {
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = dropPageCache(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// measureFiles: MB/s of reading (and hashing, if digest) the files with a pool of workers,
+// with the given --buffer-size. The files are first evicted from the page cache, where supported
+func measureFiles(paths []string, workers int, bufferSize int, digest bool) (float64, error) {
+	if pageCacheSupported {
+		if err := evictFiles(paths); err != nil {
+			return 0, err
+		}
+	}
+	defer func(saved int) { readBufferSize = saved }(readBufferSize)
+	readBufferSize = bufferSize
+	var total atomic.Int64
+	start := time.Now()
+	errs := runParallel(len(paths), workers, func(i int) error {
+		// io.Discard would read with its own (small) buffers, through io.ReaderFrom
+		dst := io.Writer(struct{ io.Writer }{io.Discard})
+		if digest {
+			dst = sha256.New()
+		}
+		n, err := readFileWith(paths[i], dst)
+		total.Add(n)
+		return err
+	})
+	elapsed := time.Since(start)
+	for _, err := range errs {
+		if err != nil {
+			return 0, err
+		}
+	}
+	return rateMBps(total.Load(), elapsed), nil
+}
+
+// selftestRecommendation: the fewest workers within 10% of the best combined rate
+func selftestRecommendation(workerCounts []int, rates []float64) int {
+	best := 0.0
+	for _, rate := range rates {
+		if rate > best {
+			best = rate
+		}
+	}
+	for i, rate := range rates {
+		if rate >= 0.9*best {
+			return workerCounts[i]
+		}
+	}
+	return 1
+}
+
+// selftestBenchCommand: reference selftest-bench [--duration d] [--max-workers n] [--max-bytes n] <directory>
+func selftestBenchCommand(args []string) error {
+	flags := flag.NewFlagSet("selftest-bench", flag.ExitOnError)
+	flags.BoolVar(verboseFlag, "verbose", false, "verbose output")
+	duration := flags.Duration("duration", 500*time.Millisecond, "duration of each hashing measurement")
+	maxWorkers := flags.Int("max-workers", runtime.NumCPU(), "largest number of goroutines (workers) measured")
+	maxBytes := flags.Int64("max-bytes", 1024*1024*1024, "read at most this much of the directory (bytes)")
+	flags.Parse(args)
+	if flags.NArg() != 1 || *maxWorkers < 1 {
+		return fmt.Errorf("usage: selftest-bench [flags] <directory>")
+	}
+	workerCounts := selftestWorkerCounts(*maxWorkers)
+
+	fmt.Printf("## Hashing from memory (MB/s) - %s - %s - %d CPUs\n\n", getHostname(), getRuntime(), runtime.NumCPU())
+	fmt.Printf("| Algorithm |")
+	for _, count := range workerCounts {
+		fmt.Printf(" %d |", count)
+	}
+	fmt.Printf("\n|:----------|")
+	for range workerCounts {
+		fmt.Printf("---:|")
+	}
+	fmt.Println()
+	for _, algorithm := range selftestAlgorithms {
+		fmt.Printf("| %s |", algorithm.Name)
+		for _, count := range workerCounts {
+			fmt.Printf(" %.2f |", measureHashing(algorithm.New, count, *duration))
+		}
+		fmt.Println()
+	}
+
+	paths, totalBytes, err := selftestFiles(flags.Arg(0), *maxBytes)
+	if err != nil {
+		return err
+	}
+	if totalBytes == 0 {
+		return fmt.Errorf("%s: no data to read", flags.Arg(0))
+	}
+	cache := "cold (evicted from the page cache before each pass)"
+	if !pageCacheSupported {
+		// the page cache can not be dropped: every pass is warm, rather than only the first one being cold
+		if _, err := measureFiles(paths, 1, 0, false); err != nil {
+			return err
+		}
+		cache = "warm (after a first, unmeasured, pass)"
+	}
+	fmt.Printf("\n## Sequential reads, no hashing (MB/s) - %d files - %.2fMB - %s\n\n", len(paths), float64(totalBytes)/1024/1024, cache)
+	fmt.Printf("| Buffer (KiB) | Rate (MB/s) |\n|-------------:|------------:|\n")
+	bestBuffer, bestReadRate := selftestBufferSizes[0], 0.0
+	for _, bufferSize := range selftestBufferSizes {
+		rate, err := measureFiles(paths, 1, bufferSize, false)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("| %d | %.2f |\n", bufferSize/1024, rate)
+		// prefer the smaller buffer, unless a larger one is clearly faster
+		if rate > 1.05*bestReadRate {
+			bestBuffer, bestReadRate = bufferSize, rate
+		}
+	}
+
+	fmt.Printf("\n## Combined: read and sha256 (MB/s) - buffer %d KiB - %s\n\n", bestBuffer/1024, cache)
+	fmt.Printf("| Workers | Rate (MB/s) |\n|--------:|------------:|\n")
+	var combinedRates []float64
+	for _, count := range workerCounts {
+		rate, err := measureFiles(paths, count, bestBuffer, true)
+		if err != nil {
+			return err
+		}
+		combinedRates = append(combinedRates, rate)
+		fmt.Printf("| %d | %.2f |\n", count, rate)
+	}
+
+	workers := selftestRecommendation(workerCounts, combinedRates)
+	fmt.Printf("\nRecommendation: --workers %d --buffer-size %s\n", workers, formatByteSize(int64(bestBuffer)))
+	return nil
+}
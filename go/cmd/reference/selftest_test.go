@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSelftestBench(t *testing.T) {
+	if counts := selftestWorkerCounts(6); !reflect.DeepEqual(counts, []int{1, 2, 4, 6}) {
+		t.Errorf("Expected 1 2 4 6 workers, got %v", counts)
+	}
+	if workers := selftestRecommendation([]int{1, 2, 4, 8}, []float64{100, 170, 195, 200}); workers != 4 {
+		t.Errorf("Expected the fewest workers within 10%% of the best rate, got %d", workers)
+	}
+	if rate := measureHashing(sha256.New, 2, 10*time.Millisecond); rate <= 0 {
+		t.Errorf("Expected a positive hashing rate, got %v", rate)
+	}
+
+	rootDirectory := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.WriteFile(filepath.Join(rootDirectory, name), make([]byte, 1024), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	paths, total, err := selftestFiles(rootDirectory, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 || total != 2048 {
+		t.Errorf("Expected to stop after --max-bytes, got %v %d", paths, total)
+	}
+	if _, err := measureFiles(paths, 2, 4096, true); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Output compatible with coreutils sha256sum (and sha256sum -c):
+//   <hex>  <path>
+// Like GNU, a file name containing a backslash, newline or carriage return
+// is escaped, and the line is then prefixed with a single backslash.
+
+var sha256sumLineRegexp = regexp.MustCompile(`^(\\?)([0-9a-fA-F]{64}) [ *](.+)$`)
+
+// sha256sumEscape: escapes a file name the way GNU sha256sum does,
+// returns true if the name was escaped (the line must then start with a backslash)
+func sha256sumEscape(name string) (string, bool) {
+	if !strings.ContainsAny(name, "\\\n\r") {
+		return name, false
+	}
+	replacer := strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r")
+	return replacer.Replace(name), true
+}
+
+// sha256sumUnescape: reverses sha256sumEscape
+func sha256sumUnescape(name string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '\\' {
+			sb.WriteByte(name[i])
+			continue
+		}
+		i++
+		if i == len(name) {
+			return "", fmt.Errorf("invalid escape at end of %q", name)
+		}
+		switch name[i] {
+		case '\\':
+			sb.WriteByte('\\')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		default:
+			return "", fmt.Errorf("invalid escape \\%c in %q", name[i], name)
+		}
+	}
+	return sb.String(), nil
+}
+
+// sha256sumLinePrefix: the prefix for a line about path, with the path escaped if needed
+func sha256sumLinePrefix(path string) (string, string) {
+	escaped, isEscaped := sha256sumEscape(path)
+	if isEscaped {
+		return "\\", escaped
+	}
+	return "", escaped
+}
+
+// formatSha256sumLine: formats a single line (without the trailing newline)
+func formatSha256sumLine(digest string, path string) string {
+	prefix, escaped := sha256sumLinePrefix(path)
+	return fmt.Sprintf("%s%s  %s", prefix, digest, escaped)
+}
+
+// parseSha256sumLine: parses a single line, in text (two spaces) or binary (space star) mode
+func parseSha256sumLine(line string) (digest string, path string, err error) {
+	matches := sha256sumLineRegexp.FindStringSubmatch(line)
+	if matches == nil {
+		return "", "", fmt.Errorf("improperly formatted line: %q", line)
+	}
+	digest, path = strings.ToLower(matches[2]), matches[3]
+	if matches[1] == "\\" {
+		path, err = sha256sumUnescape(path)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return digest, path, nil
+}
+
+// showTreeAsSha256sum: prints one line per file (directories are skipped), in traversal order
+func showTreeAsSha256sum(node DigestTreeNode) {
+	if !node.Info.Mode.IsDir() {
+		fmt.Println(formatSha256sumLine(node.Info.Sha256, node.Path))
+		return
+	}
+	for _, child := range node.Children {
+		showTreeAsSha256sum(child)
+	}
+}
+
+// checkSha256sum: verifies the files listed in a sha256sum file with the parallel hashing engine
+// Paths are relative to the current directory, as for sha256sum -c.
+// Prints a line per file as sha256sum -c does, and returns true if every file matched
+func checkSha256sum(sumsPath string, workers int) (bool, error) {
+	sumsFile, err := os.Open(sumsPath)
+	if err != nil {
+		return false, err
+	}
+	defer sumsFile.Close()
+	return checkSha256sumFrom(sumsFile, workers)
+}
+
+func checkSha256sumFrom(r io.Reader, workers int) (bool, error) {
+	defer bypassXattrCache()()
+	var expected []string
+	var nodes []DigestTreeNode
+	var statErrs []error
+	improperlyFormatted := 0
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		digest, path, err := parseSha256sumLine(line)
+		if err != nil {
+			improperlyFormatted++
+			if *verboseFlag {
+				log.Printf("checkSha256sum: %v\n", err)
+			}
+			continue
+		}
+		node := DigestTreeNode{Path: path}
+		info, err := os.Stat(path)
+		if err == nil && info.IsDir() {
+			err = fmt.Errorf("%s: Is a directory", path)
+		}
+		if err == nil {
+			node = newLeaf(path, info)
+		}
+		expected = append(expected, digest)
+		nodes = append(nodes, node)
+		statErrs = append(statErrs, err)
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+
+	// only hash the files we could stat
+	var leaves []*DigestTreeNode
+	var leafIndexes []int
+	for i := range nodes {
+		if statErrs[i] == nil {
+			leaves = append(leaves, &nodes[i])
+			leafIndexes = append(leafIndexes, i)
+		}
+	}
+	for i, err := range digestLeaves(leaves, workers) {
+		if err != nil {
+			statErrs[leafIndexes[i]] = err
+		}
+	}
+
+	unreadable, mismatched := 0, 0
+	for i, node := range nodes {
+		if statErrs[i] != nil {
+			log.Printf("%v\n", statErrs[i])
+		}
+		// like GNU (coreutils 9.1), status lines are only escaped when the name contains a newline:
+		// a backslash or carriage return alone is printed as is, but escaped along with a newline
+		prefix, escaped := "", node.Path
+		if strings.Contains(node.Path, "\n") {
+			prefix, escaped = sha256sumLinePrefix(node.Path)
+		}
+		switch {
+		case statErrs[i] != nil:
+			unreadable++
+			fmt.Printf("%s%s: FAILED open or read\n", prefix, escaped)
+		case node.Info.Sha256 != expected[i]:
+			mismatched++
+			fmt.Printf("%s%s: FAILED\n", prefix, escaped)
+		default:
+			fmt.Printf("%s%s: OK\n", prefix, escaped)
+		}
+	}
+
+	if len(nodes) == 0 {
+		return false, fmt.Errorf("no properly formatted checksum lines found")
+	}
+	if improperlyFormatted > 0 {
+		log.Printf("WARNING: %d %s improperly formatted\n", improperlyFormatted, plural(improperlyFormatted, "line is", "lines are"))
+	}
+	if unreadable > 0 {
+		log.Printf("WARNING: %d listed %s could not be read\n", unreadable, plural(unreadable, "file", "files"))
+	}
+	if mismatched > 0 {
+		log.Printf("WARNING: %d computed %s did NOT match\n", mismatched, plural(mismatched, "checksum", "checksums"))
+	}
+	return unreadable == 0 && mismatched == 0, nil
+}
+
+func plural(n int, singular, pluralForm string) string {
+	if n == 1 {
+		return singular
+	}
+	return pluralForm
+}
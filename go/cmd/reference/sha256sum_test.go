@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSha256sumLineRoundTrip(t *testing.T) {
+	digest := "315f5bdb76d078c43b8ac0064e4a0164612b1fce77c869345bfc94c75894edd3"
+	testCases := []struct {
+		Path string
+		Line string
+	}{
+		{"dir/plain.txt", digest + "  dir/plain.txt"},
+		{"with space.txt", digest + "  with space.txt"},
+		{`back\slash`, `\` + digest + `  back\\slash`},
+		{"new\nline", `\` + digest + `  new\nline`},
+		{"carriage\rreturn", `\` + digest + `  carriage\rreturn`},
+	}
+
+	for _, tc := range testCases {
+		line := formatSha256sumLine(digest, tc.Path)
+		if line != tc.Line {
+			t.Errorf("Expected line %q, but got %q", tc.Line, line)
+		}
+		parsedDigest, parsedPath, err := parseSha256sumLine(line)
+		if err != nil {
+			t.Fatalf("Error parsing line %q: %v", line, err)
+		}
+		if parsedDigest != digest || parsedPath != tc.Path {
+			t.Errorf("Expected %q %q, but got %q %q", digest, tc.Path, parsedDigest, parsedPath)
+		}
+	}
+}
+
+func TestParseSha256sumLineBinaryAndInvalid(t *testing.T) {
+	digest := "315f5bdb76d078c43b8ac0064e4a0164612b1fce77c869345bfc94c75894edd3"
+	_, path, err := parseSha256sumLine(digest + " *binary.bin")
+	if err != nil || path != "binary.bin" {
+		t.Errorf("Expected binary mode line to parse, got %q %v", path, err)
+	}
+
+	for _, line := range []string{"", "not a checksum line", digest + " nospace", digest[:10] + "  short.txt"} {
+		if _, _, err := parseSha256sumLine(line); err == nil {
+			t.Errorf("Expected error parsing %q", line)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const uringSupported = true
+
+// io_uring ABI (linux/io_uring.h), the syscall numbers are the same on amd64 and arm64
+const (
+	sysIoUringSetup = 425
+	sysIoUringEnter = 426
+
+	ioringOffSqRing = 0
+	ioringOffCqRing = 0x8000000
+	ioringOffSqes   = 0x10000000
+
+	ioringFeatSingleMmap = 1 << 0
+	ioringEnterGetevents = 1 << 0
+
+	ioringOpOpenat = 18
+	ioringOpClose  = 19
+	ioringOpRead   = 22
+
+	atFdcwd = -100
+)
+
+type uringSqOffsets struct {
+	Head, Tail, RingMask, RingEntries, Flags, Dropped, Array, Resv1 uint32
+	UserAddr                                                        uint64
+}
+
+type uringCqOffsets struct {
+	Head, Tail, RingMask, RingEntries, Overflow, Cqes, Flags, Resv1 uint32
+	UserAddr                                                        uint64
+}
+
+type uringParams struct {
+	SqEntries, CqEntries, Flags, SqThreadCpu, SqThreadIdle, Features, WqFd uint32
+	Resv                                                                   [3]uint32
+	SqOff                                                                  uringSqOffsets
+	CqOff                                                                  uringCqOffsets
+}
+
+// uringSqe: a submission queue entry (64 bytes)
+type uringSqe struct {
+	Opcode      uint8
+	Flags       uint8
+	Ioprio      uint16
+	Fd          int32
+	Off         uint64
+	Addr        uint64
+	Len         uint32
+	OpFlags     uint32 // open_flags, rw_flags...
+	UserData    uint64
+	BufIndex    uint16
+	Personality uint16
+	SpliceFdIn  int32
+	Addr3       uint64
+	Pad         uint64
+}
+
+// uringCqe: a completion queue entry (16 bytes)
+type uringCqe struct {
+	UserData uint64
+	Res      int32
+	Flags    uint32
+}
+
+// uring: a ring, used by a single goroutine
+type uring struct {
+	fd             int
+	sqRing, cqRing []byte
+	sqesMemory     []byte
+	sqTail, sqMask *uint32
+	sqArray        []uint32
+	sqes           []uringSqe
+	cqHead, cqTail *uint32
+	cqMask         *uint32
+	cqes           []uringCqe
+	entries        int
+	singleMmap     bool
+}
+
+func newUring(entries uint32) (*uring, error) {
+	var params uringParams
+	fd, _, errno := syscall.Syscall(sysIoUringSetup, uintptr(entries), uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+	r := &uring{fd: int(fd), entries: int(params.SqEntries)}
+	fail := func(err error) (*uring, error) {
+		r.close()
+		return nil, err
+	}
+
+	sqSize := int(params.SqOff.Array + params.SqEntries*4)
+	cqSize := int(params.CqOff.Cqes + params.CqEntries*uint32(unsafe.Sizeof(uringCqe{})))
+	r.singleMmap = params.Features&ioringFeatSingleMmap != 0
+	if r.singleMmap && cqSize > sqSize {
+		sqSize = cqSize
+	}
+	var err error
+	if r.sqRing, err = syscall.Mmap(r.fd, ioringOffSqRing, sqSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		return fail(os.NewSyscallError("mmap", err))
+	}
+	r.cqRing = r.sqRing
+	if !r.singleMmap {
+		if r.cqRing, err = syscall.Mmap(r.fd, ioringOffCqRing, cqSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+			return fail(os.NewSyscallError("mmap", err))
+		}
+	}
+	sqesSize := int(params.SqEntries) * int(unsafe.Sizeof(uringSqe{}))
+	if r.sqesMemory, err = syscall.Mmap(r.fd, ioringOffSqes, sqesSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE); err != nil {
+		return fail(os.NewSyscallError("mmap", err))
+	}
+
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[params.SqOff.Tail]))
+	r.sqMask = (*uint32)(unsafe.Pointer(&r.sqRing[params.SqOff.RingMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqRing[params.SqOff.Array])), params.SqEntries)
+	r.sqes = unsafe.Slice((*uringSqe)(unsafe.Pointer(&r.sqesMemory[0])), params.SqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[params.CqOff.Head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[params.CqOff.Tail]))
+	r.cqMask = (*uint32)(unsafe.Pointer(&r.cqRing[params.CqOff.RingMask]))
+	r.cqes = unsafe.Slice((*uringCqe)(unsafe.Pointer(&r.cqRing[params.CqOff.Cqes])), params.CqEntries)
+	return r, nil
+}
+
+func (r *uring) close() {
+	if r.sqesMemory != nil {
+		syscall.Munmap(r.sqesMemory)
+	}
+	if r.cqRing != nil && !r.singleMmap {
+		syscall.Munmap(r.cqRing)
+	}
+	if r.sqRing != nil {
+		syscall.Munmap(r.sqRing)
+	}
+	syscall.Close(r.fd)
+}
+
+// run: submits the entries (at most r.entries), and waits for all their completions, indexed by UserData
+// Memory referenced by the entries must be kept alive by the caller until run returns.
+// On error, the completions received so far are returned, the others fail with ECANCELED
+func (r *uring) run(prepared []uringSqe) ([]uringCqe, error) {
+	tail := atomic.LoadUint32(r.sqTail)
+	mask := *r.sqMask
+	for i, sqe := range prepared {
+		index := (tail + uint32(i)) & mask
+		r.sqes[index] = sqe
+		r.sqArray[index] = index
+	}
+	atomic.StoreUint32(r.sqTail, tail+uint32(len(prepared)))
+
+	completions := make([]uringCqe, len(prepared))
+	for i := range completions {
+		completions[i].Res = -int32(syscall.ECANCELED)
+	}
+	submitted, completed := 0, 0
+	for completed < len(prepared) {
+		n, _, errno := syscall.Syscall6(sysIoUringEnter, uintptr(r.fd), uintptr(len(prepared)-submitted), 1, ioringEnterGetevents, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return completions, os.NewSyscallError("io_uring_enter", errno)
+		}
+		submitted += int(n)
+		head := atomic.LoadUint32(r.cqHead)
+		for cqTail := atomic.LoadUint32(r.cqTail); head != cqTail; head++ {
+			cqe := r.cqes[head&*r.cqMask]
+			completions[cqe.UserData] = cqe
+			completed++
+		}
+		atomic.StoreUint32(r.cqHead, head)
+	}
+	return completions, nil
+}
+
+// uringResult: the result of a completion, as a count or an error
+func uringResult(cqe uringCqe) (int, error) {
+	if cqe.Res < 0 {
+		return 0, syscall.Errno(-cqe.Res)
+	}
+	return int(cqe.Res), nil
+}
+
+// readBatch: opens the files of a batch (at most r.entries) with one submission, reads each of them whole
+// with another, and closes them with a third. failed is set for a file which could not be read, or whose size changed.
+// Every file opened is closed, also when the ring fails
+func (r *uring) readBatch(batch []*DigestTreeNode) (buffers [][]byte, lengths []int, failed []bool, err error) {
+	paths := make([][]byte, len(batch))
+	buffers = make([][]byte, len(batch))
+	lengths = make([]int, len(batch))
+	failed = make([]bool, len(batch))
+	// fds: the files opened, and not yet closed by the ring
+	fds := make([]int, len(batch))
+	for i := range fds {
+		fds[i] = -1
+	}
+	defer func() {
+		for _, fd := range fds {
+			if fd >= 0 {
+				syscall.Close(fd)
+			}
+		}
+	}()
+
+	var opens []uringSqe
+	for i, node := range batch {
+		paths[i] = append([]byte(node.Path), 0)
+		opens = append(opens, uringSqe{Opcode: ioringOpOpenat, Fd: atFdcwd, Addr: uint64(uintptr(unsafe.Pointer(&paths[i][0]))),
+			OpFlags: syscall.O_RDONLY | syscall.O_CLOEXEC, UserData: uint64(i)})
+	}
+	completions, err := r.run(opens)
+	runtime.KeepAlive(paths)
+	for i := range batch {
+		if fd, openErr := uringResult(completions[i]); openErr == nil {
+			fds[i] = fd
+		} else {
+			failed[i] = true
+		}
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var reads, closes []uringSqe
+	var opened []int
+	for i, node := range batch {
+		if failed[i] {
+			continue
+		}
+		// one more byte than expected, to notice a file which grew
+		buffers[i] = make([]byte, node.Info.Size+1)
+		reads = append(reads, uringSqe{Opcode: ioringOpRead, Fd: int32(fds[i]), Addr: uint64(uintptr(unsafe.Pointer(&buffers[i][0]))),
+			Len: uint32(len(buffers[i])), UserData: uint64(len(reads))})
+		closes = append(closes, uringSqe{Opcode: ioringOpClose, Fd: int32(fds[i]), UserData: uint64(len(closes))})
+		opened = append(opened, i)
+	}
+	readCompletions, err := r.run(reads)
+	runtime.KeepAlive(buffers)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	closeCompletions, err := r.run(closes)
+	for j, i := range opened {
+		if closeCompletions[j].Res != -int32(syscall.ECANCELED) {
+			fds[i] = -1
+		}
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for j, i := range opened {
+		lengths[i], err = uringResult(readCompletions[j])
+		if err != nil || int64(lengths[i]) != batch[i].Info.Size {
+			failed[i] = true
+		}
+	}
+	return buffers, lengths, failed, nil
+}
+
+// digestSmallFilesUring: digests small regular files in batches (see readBatch), then hashed by a pool of workers.
+// A file which fails, or whose size changed, is digested again by digestNode, which reports its error.
+// If the ring fails after it was set up, the remaining files are digested by digestNode.
+// Returns one error per node, in order; an error if the ring could not be set up (nothing was digested)
+func digestSmallFilesUring(nodes []*DigestTreeNode, workers int) ([]error, error) {
+	r, err := newUring(64)
+	if err != nil {
+		return nil, err
+	}
+	defer r.close()
+
+	errs := make([]error, len(nodes))
+	for batchStart := 0; batchStart < len(nodes); batchStart += r.entries {
+		batchEnd := batchStart + r.entries
+		if batchEnd > len(nodes) {
+			batchEnd = len(nodes)
+		}
+		batch := nodes[batchStart:batchEnd]
+		start := time.Now()
+		buffers, lengths, failed, err := r.readBatch(batch)
+		if err != nil {
+			fallbackToStd(err.Error())
+			remaining := nodes[batchStart:]
+			copy(errs[batchStart:], runParallel(len(remaining), workers, func(i int) error {
+				return digestNode(remaining[i])
+			}))
+			return errs, nil
+		}
+		batchErrs := runParallel(len(batch), workers, func(i int) error {
+			if failed[i] {
+				return digestNode(batch[i])
+			}
+			return setLeafDigest(batch[i], fmt.Sprintf("%x", sha256.Sum256(buffers[i][:lengths[i]])), start)
+		})
+		copy(errs[batchStart:], batchErrs)
+	}
+	return errs, nil
+}
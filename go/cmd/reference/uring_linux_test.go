@@ -0,0 +1,57 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUringReader(t *testing.T) {
+	if r, err := newUring(64); err != nil {
+		t.Skipf("io_uring is not available: %v", err)
+	} else {
+		r.close()
+	}
+	defer func() { readerBackend = "std" }()
+	rootDirectory := t.TempDir()
+	// more than a batch of small files, an empty one, and one larger than the buffer
+	for i := 0; i < 150; i++ {
+		path := filepath.Join(rootDirectory, fmt.Sprintf("d%d", i%3), fmt.Sprintf("f%d", i))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(fmt.Sprintf("%0*d", i*37, i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(rootDirectory, "empty"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootDirectory, "large"), make([]byte, 3*uringMaxFileSize+1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	digest := func(backend string, workers int) DigestTreeNode {
+		readerBackend = backend
+		return digestTestDirectory(t, rootDirectory, workers)
+	}
+	openFiles := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+	expected := digest("std", 1)
+	before := openFiles()
+	for _, workers := range []int{1, 4} {
+		if actual := digest("uring", workers); actual.Info.Sha256 != expected.Info.Sha256 || actual.Info.MetaSha256 != expected.Info.MetaSha256 {
+			t.Errorf("Expected the same digests with --reader uring --workers %d", workers)
+		}
+	}
+	if after := openFiles(); after != before {
+		t.Errorf("Expected every file to be closed, %d were open before, %d after", before, after)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !(linux && (amd64 || arm64))
+
+package main
+
+import "errors"
+
+const uringSupported = false
+
+func digestSmallFilesUring(nodes []*DigestTreeNode, workers int) ([]error, error) {
+	return nil, errors.New("io_uring is only supported on linux (amd64, arm64)")
+}
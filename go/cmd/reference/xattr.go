@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// Extended attributes (--xattrs, linux only): macOS and Synology attach metadata to files as extended attributes.
+// Each entry records the names of its attributes and the sha256 of their values, which are part of its metadata digest.
+// --xattr-include and --xattr-exclude select attribute names with glob patterns (e.g. --xattr-exclude com.apple.quarantine).
+
+// captureXattrs: set by --xattrs
+var captureXattrs = false
+
+var errXattrsUnsupported = errors.New("extended attributes are only supported on linux")
+
+// xattrInclude, xattrExclude: glob patterns for attribute names, an empty xattrInclude selects every name
+var xattrInclude, xattrExclude patternFlags
+
+// patternFlags: repeatable glob pattern flag
+type patternFlags []string
+
+func (f *patternFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *patternFlags) Set(value string) error {
+	if _, err := filepath.Match(value, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", value, err)
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if match, _ := filepath.Match(pattern, name); match {
+			return true
+		}
+	}
+	return false
+}
+
+// selectXattr: whether an attribute name is captured, exclusions win
+// The digests stored by --xattr-cache are never captured: they would change the metadata digest
+func selectXattr(name string) bool {
+	if strings.HasPrefix(name, xattrCachePrefix) {
+		return false
+	}
+	if len(xattrInclude) > 0 && !matchAny(xattrInclude, name) {
+		return false
+	}
+	return !matchAny(xattrExclude, name)
+}
+
+// digestXattrs: the selected attributes of a file, as name: sha256 of the value (nil if there are none)
+func digestXattrs(path string) (map[string]string, error) {
+	attributes, err := readXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+	var digests map[string]string
+	for name, value := range attributes {
+		if !selectXattr(name) {
+			continue
+		}
+		if digests == nil {
+			digests = map[string]string{}
+		}
+		digests[name] = fmt.Sprintf("%x", sha256.Sum256(value))
+	}
+	return digests, nil
+}
+
+// setXattrs: captures the extended attributes of a node with --xattrs, symlinks are not followed
+func setXattrs(node *DigestTreeNode) error {
+	if !captureXattrs || node.Info.Mode&fs.ModeSymlink != 0 {
+		return nil
+	}
+	digests, err := digestXattrs(node.Path)
+	if err != nil {
+		return fmt.Errorf("xattrs of %s: %v", node.Path, err)
+	}
+	node.Info.Xattrs = digests
+	return nil
+}
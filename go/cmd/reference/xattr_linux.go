@@ -0,0 +1,76 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"syscall"
+)
+
+const xattrsSupported = true
+
+// readXattrs: the extended attributes of a file, none if the filesystem does not support them
+func readXattrs(path string) (map[string][]byte, error) {
+	names, err := xattrCall(func(dest []byte) (int, error) { return syscall.Listxattr(path, dest) })
+	if err != nil {
+		if errors.Is(err, syscall.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	attributes := map[string][]byte{}
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, ok, err := getXattr(path, string(name))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue // removed since it was listed
+		}
+		attributes[string(name)] = value
+	}
+	return attributes, nil
+}
+
+// getXattr: the value of an extended attribute, ok is false if the file does not have it
+func getXattr(path string, name string) (value []byte, ok bool, err error) {
+	value, err = xattrCall(func(dest []byte) (int, error) { return syscall.Getxattr(path, name, dest) })
+	if errors.Is(err, syscall.ENODATA) || errors.Is(err, syscall.ENOTSUP) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// setXattr: creates or replaces an extended attribute
+func setXattr(path string, name string, value []byte) error {
+	return syscall.Setxattr(path, name, value, 0)
+}
+
+// xattrCall: sizes the buffer with a first call, and retries if the attributes grew in between
+func xattrCall(call func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := call(nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		dest := make([]byte, size)
+		size, err = call(dest)
+		if errors.Is(err, syscall.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return dest[:size], nil
+	}
+}
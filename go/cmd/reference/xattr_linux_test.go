@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestXattrs(t *testing.T) {
+	defer func() { captureXattrs, xattrInclude, xattrExclude = false, nil, nil }()
+	rootDirectory := t.TempDir()
+	path := filepath.Join(rootDirectory, "file.txt")
+	if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Setxattr(path, "user.kept", []byte("value"), 0); err != nil {
+		t.Skipf("extended attributes are not supported here: %v", err)
+	}
+	if err := syscall.Setxattr(path, "user.quarantine", []byte("noise"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	captureXattrs, xattrExclude = true, patternFlags{"user.quar*"}
+	before := digestTestDirectory(t, rootDirectory, 1)
+	xattrs := before.Children[0].Info.Xattrs
+	if len(xattrs) != 1 || xattrs["user.kept"] == "" {
+		t.Fatalf("Expected only user.kept, got %v", xattrs)
+	}
+
+	// an excluded attribute does not change the metadata digest, a captured one does
+	if err := syscall.Setxattr(path, "user.quarantine", []byte("changed"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if digestTestDirectory(t, rootDirectory, 1).Info.MetaSha256 != before.Info.MetaSha256 {
+		t.Errorf("Expected an excluded attribute not to change the metadata digest")
+	}
+	if err := syscall.Setxattr(path, "user.kept", []byte("changed"), 0); err != nil {
+		t.Fatal(err)
+	}
+	after := digestTestDirectory(t, rootDirectory, 1)
+	if after.Info.MetaSha256 == before.Info.MetaSha256 {
+		t.Errorf("Expected a captured attribute to change the metadata digest")
+	}
+	if after.Info.Sha256 != before.Info.Sha256 {
+		t.Errorf("Expected the content digest to be unchanged")
+	}
+}
+
+func TestXattrCache(t *testing.T) {
+	defer func() { useXattrCache = false }()
+	path := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Setxattr(path, "user.probe", nil, 0); err != nil {
+		t.Skipf("extended attributes are not supported here: %v", err)
+	}
+	useXattrCache = true
+	digest, err := digestFileCached(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, ok, err := readCachedDigest(path)
+	if err != nil || !ok || cached.Sha256 != digest || !cached.matches(info) {
+		t.Fatalf("Expected the digest to be stored, got %v %v %v", cached, ok, err)
+	}
+	rootDirectory := filepath.Dir(path)
+	var spec strings.Builder
+	writeMtree(&spec, digestTestDirectory(t, rootDirectory, 1))
+	specPath := filepath.Join(t.TempDir(), "spec.mtree")
+	if err := os.WriteFile(specPath, []byte(spec.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// same size and modification time, different content: the stored digest is trusted, and check-xattrs reports it
+	if err := os.WriteFile(path, []byte("CONTENT"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if reused, _ := digestFileCached(path); reused != digest {
+		t.Errorf("Expected the stored digest to be reused")
+	}
+	if err := checkXattrsCommand([]string{rootDirectory}); err != errInvalid {
+		t.Errorf("Expected check-xattrs to report the corruption, got %v", err)
+	}
+
+	// --check bypasses the cache, and reports it too
+	if ok, err := checkSha256sumFrom(strings.NewReader(digest+"  "+path+"\n"), 1); err != nil || ok {
+		t.Errorf("Expected --check to report the corruption, got %v %v", ok, err)
+	}
+	if !useXattrCache {
+		t.Errorf("Expected the cache to be enabled again after --check")
+	}
+	if ok, err := checkMtree(specPath, rootDirectory, 1); err != nil || ok {
+		t.Errorf("Expected --check with --format mtree to report the corruption, got %v %v", ok, err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+const xattrsSupported = false
+
+// readXattrs: extended attributes are only captured on linux
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, errXattrsUnsupported
+}
+
+func getXattr(path string, name string) (value []byte, ok bool, err error) {
+	return nil, false, errXattrsUnsupported
+}
+
+func setXattr(path string, name string, value []byte) error {
+	return errXattrsUnsupported
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// The xattr cache (--xattr-cache, linux only): the sha256 of a file is stored in its own extended attributes,
+// with the modification time and size it was computed at. Later runs trust it when both are unchanged.
+// It travels with the file when copied with its extended attributes (cp -a, rsync -X).
+// check-xattrs rehashes the files and compares with the stored digests: a mismatch with an unchanged
+// modification time and size means the content changed behind the filesystem's back (bit rot).
+
+const (
+	xattrCachePrefix = "user.dd."
+	xattrCacheSha256 = xattrCachePrefix + "sha256"
+	xattrCacheMtime  = xattrCachePrefix + "mtime" // unix nanoseconds
+	xattrCacheSize   = xattrCachePrefix + "size"
+)
+
+// useXattrCache: set by --xattr-cache
+var useXattrCache = false
+
+// xattrCacheReused, xattrCacheStored: counts of digests read from and written to the cache
+var xattrCacheReused, xattrCacheStored atomic.Int64
+
+// cachedDigest: a digest stored in a file's extended attributes, and the file's stamp when it was computed
+type cachedDigest struct {
+	Sha256  string
+	ModTime int64 // unix nanoseconds
+	Size    int64
+}
+
+func newCachedDigest(digest string, info os.FileInfo) cachedDigest {
+	return cachedDigest{Sha256: digest, ModTime: info.ModTime().UnixNano(), Size: info.Size()}
+}
+
+// matches: the file's modification time and size are those the digest was computed at
+func (cached cachedDigest) matches(info os.FileInfo) bool {
+	return cached.ModTime == info.ModTime().UnixNano() && cached.Size == info.Size()
+}
+
+// readCachedDigest: ok is false if the file has no (complete and well formed) stored digest
+func readCachedDigest(path string) (cachedDigest, bool, error) {
+	var values [3][]byte
+	for i, name := range []string{xattrCacheSha256, xattrCacheMtime, xattrCacheSize} {
+		value, ok, err := getXattr(path, name)
+		if err != nil || !ok {
+			return cachedDigest{}, false, err
+		}
+		values[i] = value
+	}
+	modTime, errMtime := strconv.ParseInt(string(values[1]), 10, 64)
+	size, errSize := strconv.ParseInt(string(values[2]), 10, 64)
+	if len(values[0]) != 64 || errMtime != nil || errSize != nil {
+		return cachedDigest{}, false, nil
+	}
+	return cachedDigest{Sha256: string(values[0]), ModTime: modTime, Size: size}, true, nil
+}
+
+// writeCachedDigest: the digest is written last, so that an interrupted write leaves no matching stamp behind
+func writeCachedDigest(path string, cached cachedDigest) error {
+	if err := setXattr(path, xattrCacheMtime, []byte(strconv.FormatInt(cached.ModTime, 10))); err != nil {
+		return err
+	}
+	if err := setXattr(path, xattrCacheSize, []byte(strconv.FormatInt(cached.Size, 10))); err != nil {
+		return err
+	}
+	return setXattr(path, xattrCacheSha256, []byte(cached.Sha256))
+}
+
+// digestFileCached: digestFile, through the xattr cache with --xattr-cache
+// The digest is only stored if the file was not modified while it was hashed
+func digestFileCached(path string) (string, error) {
+	if !useXattrCache {
+		return digestFile(path)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if cached, ok, err := readCachedDigest(path); err == nil && ok && cached.matches(before) {
+		xattrCacheReused.Add(1)
+		return cached.Sha256, nil
+	}
+	digest, err := digestFile(path)
+	if err != nil {
+		return "", err
+	}
+	after, err := os.Stat(path)
+	if err != nil || !newCachedDigest(digest, before).matches(after) {
+		return digest, nil
+	}
+	if err := writeCachedDigest(path, newCachedDigest(digest, before)); err != nil {
+		log.Printf("xattr cache: %s: %v\n", path, err)
+		runErrors.Add(1)
+	} else {
+		xattrCacheStored.Add(1)
+	}
+	return digest, nil
+}
+
+// bypassXattrCache: disables the cache until the returned function is called
+// Checks (--check) rehash every file: a stored digest would hide the very corruption they look for
+func bypassXattrCache() (restore func()) {
+	saved := useXattrCache
+	useXattrCache = false
+	return func() { useXattrCache = saved }
+}
+
+// checkXattrsCommand: reference check-xattrs [--workers n] <directory>
+// Rehashes every file which has a stored digest, and compares
+func checkXattrsCommand(args []string) error {
+	flags := flag.NewFlagSet("check-xattrs", flag.ExitOnError)
+	flags.BoolVar(verboseFlag, "verbose", false, "verbose output (also lists files without a stored digest)")
+	workers := flags.Int("workers", 1, "number of files digested in parallel")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: check-xattrs [flags] <directory>")
+	}
+	if !xattrsSupported {
+		return errXattrsUnsupported
+	}
+	rootDirectory := flags.Arg(0)
+
+	rootInfo, err := os.Stat(rootDirectory)
+	if err != nil {
+		return err
+	}
+	rootNode, err := buildTree(rootDirectory, rootInfo)
+	if err != nil {
+		return err
+	}
+	var leaves []*DigestTreeNode
+	collectLeaves(&rootNode, &leaves)
+
+	// status of each leaf: OK, CORRUPTED (unchanged stamp), MODIFIED (stale digest) or NO DIGEST
+	statuses := make([]string, len(leaves))
+	errs := runParallel(len(leaves), *workers, func(i int) error {
+		path := leaves[i].Path
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		cached, ok, err := readCachedDigest(path)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			statuses[i] = "NO DIGEST"
+			return nil
+		}
+		digest, err := digestFile(path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case digest == cached.Sha256:
+			statuses[i] = "OK"
+		case cached.matches(info):
+			statuses[i] = "CORRUPTED"
+		default:
+			statuses[i] = "MODIFIED"
+		}
+		return nil
+	})
+
+	counts := map[string]int{}
+	for i, leaf := range leaves {
+		if errs[i] != nil {
+			log.Printf("%v\n", errs[i])
+			statuses[i] = "FAILED open or read"
+		}
+		counts[statuses[i]]++
+		if statuses[i] != "NO DIGEST" || *verboseFlag {
+			fmt.Printf("%s: %s\n", leaf.Path, statuses[i])
+		}
+	}
+	log.Printf("check-xattrs: %d ok - %d corrupted - %d modified - %d without a digest - %d unreadable\n",
+		counts["OK"], counts["CORRUPTED"], counts["MODIFIED"], counts["NO DIGEST"], counts["FAILED open or read"])
+	if counts["CORRUPTED"] > 0 || counts["FAILED open or read"] > 0 {
+		return errInvalid
+	}
+	return nil
+}
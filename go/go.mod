@@ -1,3 +1,5 @@
 module github.com/daneroo/directory-digester/go
 
 go 1.20
+
+require golang.org/x/text v0.14.0
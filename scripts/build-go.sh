@@ -5,7 +5,7 @@
 # This script builds a Go package for multiple platforms.
 # It is intended to be run from the root of the repository.
 # Usage: ./build/build-go.sh <package-name>
-#   e.g. ./build/build-go.sh go/cmd/reference/reference.go
+#   e.g. ./build/build-go.sh ./go/cmd/reference
 package=$1
 if [[ -z "$package" ]]; then
   echo "usage: $0 <package-name>"
@@ -56,10 +56,10 @@ cat << EOF
 # Pull the new binaries from this machine (${build_host})
 
 # from davinci, shannon: copy from galois"
-scp -p ${build_host}:${bin_dir}/reference.go-darwin-arm64 ./directory-digester-reference
+scp -p ${build_host}:${bin_dir}/reference-darwin-arm64 ./directory-digester-reference
 time ./directory-digester-reference --verbose  /Volumes/Space/Home-Movies/Tapes/
 
 # from syno: copy from galois
-scp -p ${build_host}:${bin_dir}/reference.go-linux-amd64 ./directory-digester-reference
+scp -p ${build_host}:${bin_dir}/reference-linux-amd64 ./directory-digester-reference
 time ./directory-digester-reference --verbose  /volume1/Home-Movies/Tapes/
 EOF